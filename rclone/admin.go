@@ -0,0 +1,57 @@
+package rclone
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+//newAdminCmd setup the admin command to act on the running daemon through its admin socket
+func newAdminCmd() *cobra.Command {
+	adminCmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Act on the running daemon through its admin socket",
+	}
+	reloadCmd := &cobra.Command{
+		Use:   "reload-config",
+		Short: "Remount the volumes in use relying on the shared rclone config to apply its changes",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := openDaemon()
+			if err != nil {
+				return err
+			}
+			remounted, err := c.ReloadConfig()
+			for _, mount := range remounted {
+				fmt.Fprintln(cmd.OutOrStdout(), mount)
+			}
+			return err
+		},
+	}
+	rotateCmd := &cobra.Command{
+		Use:   "rotate-logs",
+		Short: "Rotate the log files of the daemon and of the volumes",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := openDaemon()
+			if err != nil {
+				return err
+			}
+			return c.RotateLogs()
+		},
+	}
+	goroutinesCmd := &cobra.Command{
+		Use:   "goroutines",
+		Short: "Dump the goroutines of the daemon",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := openDaemon()
+			if err != nil {
+				return err
+			}
+			return c.Goroutines(cmd.OutOrStdout())
+		},
+	}
+	adminCmd.AddCommand(reloadCmd, rotateCmd, goroutinesCmd)
+	return adminCmd
+}
@@ -0,0 +1,259 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/rs/zerolog/log"
+)
+
+//Open load the driver state without reconciling nor supervising mounts, for offline administration
+func Open(root string, options ...Option) (*RcloneDriver, error) {
+	d := newDriver(root, options...)
+	p, _, err := loadConfig()
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Volumes != nil {
+		d.volumes = p.Volumes
+	}
+	if p.Mounts != nil {
+		d.mounts = p.Mounts
+	}
+	return d, nil
+}
+
+//Volumes describe all volumes sorted by name with their status
+func (d *RcloneDriver) Volumes() ([]*volume.Volume, error) {
+	d.refresh()
+	d.RLock()
+	names := make([]string, 0, len(d.volumes))
+	for name := range d.volumes {
+		names = append(names, name)
+	}
+	d.RUnlock()
+	sort.Strings(names)
+
+	vols := make([]*volume.Volume, 0, len(names))
+	for _, name := range names {
+		vol, err := d.volumeInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		vols = append(vols, vol)
+	}
+	return vols, nil
+}
+
+//Inspect describe the volume with its status
+func (d *RcloneDriver) Inspect(name string) (*volume.Volume, error) {
+	d.refresh()
+	return d.volumeInfo(name)
+}
+
+//RemoveVolume remove the volume, refusing if it is in use unless forced
+func (d *RcloneDriver) RemoveVolume(name string, force bool) error {
+	d.refresh()
+	log.Info().Msgf("Admin removing volume %s (force: %v)", name, force)
+	return d.removeVolume(name, force)
+}
+
+//UnmountVolume unmount the mountpoint of the volume and forget all its references
+func (d *RcloneDriver) UnmountVolume(name string) error {
+	v, m, unlock, err := d.lockMountpoint(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	d.RLock()
+	log.Info().Msgf("Admin unmounting %s used by %v", m.Path, m.IDs)
+	d.RUnlock()
+	if err := d.stopMount(v, m); err != nil {
+		return err
+	}
+	d.Lock()
+	m.clearRefs()
+	d.updateConnections(v.Mount)
+	d.Unlock()
+	return d.saveConfig()
+}
+
+//Prune repair the state: remove mountpoints without volume, forget references of mountpoints not mounted anymore
+//and unmount mountpoints not used by any container. It return the actions done.
+func (d *RcloneDriver) Prune() ([]string, error) {
+	actions := make([]string, 0)
+	for _, mount := range d.mountNames() {
+		action, err := d.pruneMount(mount)
+		if err != nil {
+			return actions, err
+		}
+		if action != "" {
+			actions = append(actions, fmt.Sprintf("%s: %s", mount, action))
+		}
+	}
+	if len(actions) == 0 {
+		return actions, nil
+	}
+	return actions, d.saveConfig()
+}
+
+//pruneMount repair the state of the mountpoint and describe what was done
+func (d *RcloneDriver) pruneMount(mount string) (string, error) {
+	d.RLock()
+	m, ok := d.mounts[mount]
+	d.RUnlock()
+	if !ok {
+		return "", nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	d.RLock()
+	current := d.mounts[mount] == m
+	volumes := d.mountVolumes(mount)
+	v := &rcloneVolume{Mount: mount}
+	if len(volumes) > 0 {
+		v = d.volumes[volumes[0]]
+	}
+	refs, pending := len(m.IDs), m.pending
+	d.RUnlock()
+	if !current {
+		return "", nil
+	}
+	if len(volumes) == 0 {
+		if err := d.dropMountpoint(mount, m); err != nil {
+			return "", err
+		}
+		return "removed mountpoint without volume", nil
+	}
+	mounted, err := d.isMounted(m)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case !mounted && refs > 0 && pending == 0:
+		d.Lock()
+		defer d.Unlock()
+		m.clearRefs()
+		d.updateConnections(mount)
+		return fmt.Sprintf("forgot %d references of unmounted mountpoint", refs), nil
+	case mounted && refs == 0:
+		if err := d.stopMount(v, m); err != nil {
+			return "", err
+		}
+		return "unmounted unused mountpoint", nil
+	}
+	return "", nil
+}
+
+//RemountVolume restart the mount of the volume in place, keeping the containers using it
+func (d *RcloneDriver) RemountVolume(name string) error {
+	v, m, unlock, err := d.lockMountpoint(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	d.RLock()
+	ids := fmt.Sprint(m.IDs)
+	inUse := len(m.IDs) > 0
+	d.RUnlock()
+	if !inUse {
+		return fmt.Errorf("volume %s is not used by any container", name)
+	}
+	log.Info().Msgf("Admin remounting %s used by %s", m.Path, ids)
+	err = d.remount(name, v, m)
+	if errSave := d.saveConfig(); err == nil {
+		err = errSave
+	}
+	return err
+}
+
+//ReloadConfig check the shared config and remount the mountpoints in use relying on it to apply its changes
+//It return the remounted mountpoints.
+func (d *RcloneDriver) ReloadConfig() ([]string, error) {
+	if _, err := configSections(sharedConfigPath()); err != nil {
+		return nil, fmt.Errorf("unable to read shared config: %v", err)
+	}
+	remounted := make([]string, 0)
+	var failed []string
+	for _, mount := range d.mountNames() {
+		ok, err := d.reloadMount(mount)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", mount, err))
+		} else if ok {
+			remounted = append(remounted, mount)
+		}
+	}
+	if err := d.saveConfig(); err != nil {
+		return remounted, err
+	}
+	if len(failed) > 0 {
+		return remounted, fmt.Errorf("unable to reload %s", strings.Join(failed, ", "))
+	}
+	return remounted, nil
+}
+
+//reloadMount remount the mountpoint if in use and relying on the shared config and return true if remounted
+func (d *RcloneDriver) reloadMount(mount string) (bool, error) {
+	d.RLock()
+	m, ok := d.mounts[mount]
+	d.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	d.RLock()
+	volumes := d.mountVolumes(mount)
+	inUse := len(m.IDs) > 0 && len(volumes) > 0 && d.mounts[mount] == m
+	var v *rcloneVolume
+	if inUse {
+		v = d.volumes[volumes[0]]
+	}
+	d.RUnlock()
+	if !inUse || v.Config != "" {
+		return false, nil
+	}
+	if err := checkSharedRemote(v.Remote); err != nil {
+		return false, err
+	}
+	log.Info().Msgf("Admin remounting %s to reload shared config", m.Path)
+	if err := d.remount(volumes[0], v, m); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//remount stop and start again the mountpoint, keeping its references
+//It must be called with the mountpoint lock held.
+func (d *RcloneDriver) remount(name string, v *rcloneVolume, m *rcloneMountpoint) error {
+	if err := d.stopMount(v, m); err != nil {
+		return err
+	}
+	if err := d.startMount(name, v, m); err != nil {
+		d.Lock()
+		m.LastError = err.Error()
+		d.Unlock()
+		return err
+	}
+	return nil
+}
+
+//mountNames return the sorted names of mountpoints
+func (d *RcloneDriver) mountNames() []string {
+	d.RLock()
+	defer d.RUnlock()
+	names := make([]string, 0, len(d.mounts))
+	for mount := range d.mounts {
+		names = append(names, mount)
+	}
+	sort.Strings(names)
+	return names
+}
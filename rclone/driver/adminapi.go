@@ -0,0 +1,257 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/rs/zerolog/log"
+)
+
+//adminError body of a failed admin API call
+type adminError struct {
+	Err string
+}
+
+//ServeAdmin serve the admin API on the unix socket until Close is called
+func (d *RcloneDriver) ServeAdmin(socket string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return err
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	go func() {
+		<-d.ctx.Done()
+		l.Close()
+	}()
+	log.Info().Msgf("Serving admin API on %s", socket)
+	err = http.Serve(l, d.AdminHandler())
+	select {
+	case <-d.ctx.Done():
+		return nil
+	default:
+		return err
+	}
+}
+
+//AdminHandler return a http handler of the admin API of the driver
+//
+//	GET    /volumes                    list volumes with their live status
+//	GET    /volumes/<name>             inspect a volume
+//	DELETE /volumes/<name>[?force=1]   remove a volume
+//	POST   /volumes/<name>/unmount     unmount a volume and forget the containers using it
+//	POST   /volumes/<name>/remount     restart the mount of a volume in place
+//	POST   /prune                      repair the state (see Prune)
+//	POST   /config/reload              remount the mounts relying on the shared config
+//	POST   /logs/rotate                rotate the log files
+//	GET    /debug/goroutines           dump the goroutines of the daemon
+func (d *RcloneDriver) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/volumes", adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		vols, err := d.Volumes()
+		writeAdmin(w, vols, err)
+	}))
+	mux.HandleFunc("/volumes/", d.adminVolume)
+	mux.HandleFunc("/prune", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		actions, err := d.Prune()
+		writeAdmin(w, actions, err)
+	}))
+	mux.HandleFunc("/config/reload", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		remounted, err := d.ReloadConfig()
+		writeAdmin(w, remounted, err)
+	}))
+	mux.HandleFunc("/logs/rotate", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		writeAdmin(w, nil, RotateLogs())
+	}))
+	mux.HandleFunc("/debug/goroutines", adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := pprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+			log.Warn().Err(err).Msg("Unable to dump goroutines")
+		}
+	}))
+	return mux
+}
+
+//adminVolume handle the calls on /volumes/<name>[/<action>]
+func (d *RcloneDriver) adminVolume(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/volumes/"), "/", 2)
+	name, action := parts[0], ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		vol, err := d.Inspect(name)
+		writeAdmin(w, vol, err)
+	case action == "" && r.Method == http.MethodDelete:
+		force := r.URL.Query().Get("force") == "1"
+		writeAdmin(w, nil, d.RemoveVolume(name, force))
+	case action == "unmount" && r.Method == http.MethodPost:
+		writeAdmin(w, nil, d.UnmountVolume(name))
+	case action == "remount" && r.Method == http.MethodPost:
+		writeAdmin(w, nil, d.RemountVolume(name))
+	case action == "" || action == "unmount" || action == "remount":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//adminMethod restrict the handler to the http method
+func adminMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+//writeAdmin write the result of an admin call as json
+func writeAdmin(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "not found") {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		v = adminError{Err: err.Error()}
+	}
+	if v == nil {
+		v = struct{}{}
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn().Err(err).Msg("Unable to write admin answer")
+	}
+}
+
+//AdminClient call the admin API of a running daemon
+type AdminClient struct {
+	client *http.Client
+}
+
+//NewAdminClient return a client of the admin API served on the unix socket
+func NewAdminClient(socket string) *AdminClient {
+	return &AdminClient{client: unixHTTPClient(socket)}
+}
+
+//Volumes implement the admin API call
+func (c *AdminClient) Volumes() ([]*volume.Volume, error) {
+	var vols []*volume.Volume
+	return vols, c.call(http.MethodGet, "/volumes", &vols)
+}
+
+//Inspect implement the admin API call
+func (c *AdminClient) Inspect(name string) (*volume.Volume, error) {
+	var vol volume.Volume
+	if err := c.call(http.MethodGet, "/volumes/"+url.PathEscape(name), &vol); err != nil {
+		return nil, err
+	}
+	return &vol, nil
+}
+
+//RemoveVolume implement the admin API call
+func (c *AdminClient) RemoveVolume(name string, force bool) error {
+	path := "/volumes/" + url.PathEscape(name)
+	if force {
+		path += "?force=1"
+	}
+	return c.call(http.MethodDelete, path, nil)
+}
+
+//UnmountVolume implement the admin API call
+func (c *AdminClient) UnmountVolume(name string) error {
+	return c.call(http.MethodPost, "/volumes/"+url.PathEscape(name)+"/unmount", nil)
+}
+
+//RemountVolume implement the admin API call
+func (c *AdminClient) RemountVolume(name string) error {
+	return c.call(http.MethodPost, "/volumes/"+url.PathEscape(name)+"/remount", nil)
+}
+
+//Prune implement the admin API call
+func (c *AdminClient) Prune() ([]string, error) {
+	var actions []string
+	return actions, c.call(http.MethodPost, "/prune", &actions)
+}
+
+//ReloadConfig implement the admin API call
+func (c *AdminClient) ReloadConfig() ([]string, error) {
+	var remounted []string
+	return remounted, c.call(http.MethodPost, "/config/reload", &remounted)
+}
+
+//RotateLogs implement the admin API call
+func (c *AdminClient) RotateLogs() error {
+	return c.call(http.MethodPost, "/logs/rotate", nil)
+}
+
+//Goroutines write the goroutines dump of the daemon to w
+func (c *AdminClient) Goroutines(w io.Writer) error {
+	resp, err := c.do(http.MethodGet, "/debug/goroutines")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+//call do the admin call and decode its json answer in out (if not nil)
+func (c *AdminClient) call(method, path string, out interface{}) error {
+	resp, err := c.do(method, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+//do send the admin request and turn failed answers into errors
+func (c *AdminClient) do(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://admin"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var e adminError
+	if json.Unmarshal(body, &e) == nil && e.Err != "" {
+		return nil, errors.New(e.Err)
+	}
+	return nil, fmt.Errorf("admin %s %s failed (%d): %s", method, path, resp.StatusCode, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	//RcloneBinary rclone binary to use, looked up in PATH and usual locations if not a path
+	RcloneBinary = "rclone"
+	//MinRcloneVersion minimum supported rclone version
+	MinRcloneVersion = "1.52.0"
+	//MinRcRcloneVersion minimum rclone version of the rc backend (rc API served on a unix socket)
+	MinRcRcloneVersion = "1.61.0"
+	//rcloneSearchPaths folders searched for the binary when not in PATH (minimal PATH of managed plugins)
+	rcloneSearchPaths   = []string{"/usr/bin", "/usr/local/bin"}
+	rcloneVersionRegexp = regexp.MustCompile(`^rclone (v[0-9]+\.[0-9]+\S*)`)
+	//rclonePath and rcloneVersion are set by CheckRclone
+	rclonePath    = ""
+	rcloneVersion = ""
+)
+
+//rcloneBinary return the rclone binary found by CheckRclone or RcloneBinary if not checked
+func rcloneBinary() string {
+	if rclonePath == "" {
+		return RcloneBinary
+	}
+	return rclonePath
+}
+
+//rcloneCommand return the command running rclone with args
+func rcloneCommand(args ...string) *exec.Cmd {
+	return exec.Command(rcloneBinary(), args...)
+}
+
+//locateRclone resolve RcloneBinary to the path of an executable
+func locateRclone() (string, error) {
+	if strings.ContainsRune(RcloneBinary, os.PathSeparator) {
+		info, err := os.Stat(RcloneBinary)
+		if err != nil {
+			return "", err
+		}
+		if info.IsDir() || info.Mode()&0111 == 0 {
+			return "", fmt.Errorf("%s is not executable", RcloneBinary)
+		}
+		return RcloneBinary, nil
+	}
+	if path, err := exec.LookPath(RcloneBinary); err == nil {
+		return path, nil
+	}
+	for _, dir := range rcloneSearchPaths {
+		path := filepath.Join(dir, RcloneBinary)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in PATH nor in %s", RcloneBinary, strings.Join(rcloneSearchPaths, ", "))
+}
+
+//parseVersion parse a version as major, minor and patch numbers (ex: 1.53.3 or v1.53)
+func parseVersion(version string) ([3]int, error) {
+	var v [3]int
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	for i, part := range parts {
+		end := 0 //Drop suffix (ex: 3-DEV, 0-beta.5)
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		n, err := strconv.Atoi(part[:end])
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q", version)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+//parseRcloneVersion extract the version from the output of `rclone version`
+func parseRcloneVersion(output string) (string, error) {
+	m := rcloneVersionRegexp.FindStringSubmatch(strings.TrimSpace(output))
+	if m == nil {
+		return "", fmt.Errorf("unable to parse rclone version from %q", strings.SplitN(output, "\n", 2)[0])
+	}
+	return m[1], nil
+}
+
+//olderVersion check if version is older than min
+func olderVersion(version, min string) (bool, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	m, err := parseVersion(min)
+	if err != nil {
+		return false, err
+	}
+	for i := range v {
+		if v[i] != m[i] {
+			return v[i] < m[i], nil
+		}
+	}
+	return false, nil
+}
+
+//checkMinVersion verify that version is at least MinRcloneVersion
+func checkMinVersion(version string) error {
+	older, err := olderVersion(version, MinRcloneVersion)
+	if err != nil {
+		return err
+	}
+	if older {
+		return fmt.Errorf("rclone %s is older than minimum supported version %s", version, MinRcloneVersion)
+	}
+	return nil
+}
+
+//CheckRcBackend verify that the rclone found by CheckRclone can serve the rc API on a unix socket
+//Nothing is checked if CheckRclone wasn't called.
+func CheckRcBackend() error {
+	if rcloneVersion == "" {
+		return nil
+	}
+	older, err := olderVersion(rcloneVersion, MinRcRcloneVersion)
+	if err != nil {
+		return err
+	}
+	if older {
+		return fmt.Errorf("rclone %s is older than %s, minimum version of the rc backend", rcloneVersion, MinRcRcloneVersion)
+	}
+	return nil
+}
+
+//CheckRclone locate the rclone binary, check its version and return them
+//The binary found is then used for all mounts.
+func CheckRclone() (string, string, error) {
+	rclonePath, rcloneVersion = "", ""
+	path, err := locateRclone()
+	if err != nil {
+		return "", "", err
+	}
+	out, err := runCommand(context.Background(), OpVersion, path, "version")
+	if err != nil {
+		return path, "", fmt.Errorf("unable to run %s version: %w", path, err)
+	}
+	version, err := parseRcloneVersion(out)
+	if err != nil {
+		return path, "", err
+	}
+	if err := checkMinVersion(version); err != nil {
+		return path, version, err
+	}
+	rclonePath, rcloneVersion = path, version
+	log.Debug().Msgf("Using rclone %s from %s", version, path)
+	return path, version, nil
+}
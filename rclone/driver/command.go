@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	//OpMount start of a mount until it is ready
+	OpMount = "mount"
+	//OpUnmount unmount of a mountpoint
+	OpUnmount = "unmount"
+	//OpPurge purge of the remote path of a removed volume
+	OpPurge = "purge"
+	//OpVersion check of the rclone binary version
+	OpVersion = "version"
+	//OpRc call of the rclone rc API and start of its daemon
+	OpRc = "rc"
+)
+
+//CommandTimeouts timeout of external operations by type in seconds, MountTimeout is used if unset or 0
+var CommandTimeouts = map[string]int{}
+
+//commandOps operation types accepted in CommandTimeouts
+var commandOps = []string{OpMount, OpUnmount, OpPurge, OpVersion, OpRc}
+
+//TimeoutError is returned when an external operation doesn't finish before its deadline
+type TimeoutError struct {
+	Op      string
+	Command string
+	Timeout time.Duration
+	Output  string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: %s timed out after %v: %s", e.Op, e.Command, e.Timeout, e.Output)
+}
+
+//Unwrap make errors.Is(err, context.DeadlineExceeded) true
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+//ExitError is returned when an external command exits with a non-zero status
+type ExitError struct {
+	Op      string
+	Command string
+	Code    int
+	Output  string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s: %s exited with status %d: %s", e.Op, e.Command, e.Code, e.Output)
+}
+
+//BinaryNotFoundError is returned when the binary of an external command is missing
+type BinaryNotFoundError struct {
+	Binary string
+	Err    error
+}
+
+func (e *BinaryNotFoundError) Error() string {
+	return fmt.Sprintf("binary %s not found: %v", e.Binary, e.Err)
+}
+
+func (e *BinaryNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+//ParseCommandTimeouts parse timeouts by operation type (ex: unmount=60,purge=600)
+func ParseCommandTimeouts(spec string) (map[string]int, error) {
+	timeouts := make(map[string]int)
+	for _, part := range strings.Split(spec, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		op := strings.TrimSpace(kv[0])
+		if !isCommandOp(op) {
+			return nil, fmt.Errorf("unknown operation %q (%s)", op, strings.Join(commandOps, ", "))
+		}
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("missing timeout of operation %s", op)
+		}
+		seconds, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid timeout %q of operation %s", kv[1], op)
+		}
+		timeouts[op] = seconds
+	}
+	return timeouts, nil
+}
+
+//isCommandOp check if op is a known operation type
+func isCommandOp(op string) bool {
+	for _, known := range commandOps {
+		if op == known {
+			return true
+		}
+	}
+	return false
+}
+
+//commandTimeout return the timeout of the operation type
+func commandTimeout(op string) time.Duration {
+	if seconds := CommandTimeouts[op]; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(MountTimeout) * time.Second
+}
+
+//commandContext return a context of the operation limited to its timeout and cancelled with parent
+func commandContext(parent context.Context, op string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, commandTimeout(op))
+}
+
+//runCommand run the external command within the deadline of the operation and return its standard output
+//Failures are returned as TimeoutError, ExitError, BinaryNotFoundError or wrap context.Canceled.
+func runCommand(parent context.Context, op, name string, args ...string) (string, error) {
+	ctx, cancel := commandContext(parent, op)
+	defer cancel()
+	command := name
+	for _, arg := range args {
+		command += " " + redactRemote(arg)
+	}
+	log.Debug().Msgf("Running %s: %s", op, command)
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return stdout.String(), nil
+	}
+	output := strings.TrimSpace(stderr.String() + stdout.String())
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return "", &TimeoutError{Op: op, Command: command, Timeout: commandTimeout(op), Output: output}
+	case errors.Is(ctx.Err(), context.Canceled):
+		return "", fmt.Errorf("%s: %s cancelled: %w", op, command, ctx.Err())
+	case errors.As(err, &exitErr):
+		return "", &ExitError{Op: op, Command: command, Code: exitErr.ExitCode(), Output: output}
+	}
+	return "", startError(name, err)
+}
+
+//startError turn the failure to start a binary into a BinaryNotFoundError if it is missing
+func startError(binary string, err error) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return &BinaryNotFoundError{Binary: binary, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package driver
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	//RuntimeFolder folder holding per mountpoint runtime files (rclone config, ...)
+	RuntimeFolder = "/run/docker-volumes/rclone/"
+	//SharedConfigFile rclone config used by volumes created without config option (default to rclone.conf in CfgFolder)
+	SharedConfigFile = ""
+)
+
+const configFileName = "rclone.conf"
+
+//sharedConfigPath return the path of the rclone config shared by volumes
+func sharedConfigPath() string {
+	if SharedConfigFile != "" {
+		return SharedConfigFile
+	}
+	return filepath.Join(CfgFolder, configFileName)
+}
+
+//remoteName return the name of the config section used by remote (empty for local path or on the fly remote)
+func remoteName(remote string) string {
+	idx := strings.Index(remote, ":")
+	if idx <= 0 || strings.ContainsAny(remote[:idx], "/\\") {
+		return ""
+	}
+	return remote[:idx]
+}
+
+//configSections list the sections (remote names) of a rclone config file
+func configSections(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, err := parseConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	sections := make(map[string]bool)
+	for name := range config {
+		sections[name] = true
+	}
+	return sections, nil
+}
+
+//parseConfig read the parameters of each section (remote) of a rclone config
+func parseConfig(r io.Reader) (map[string]map[string]string, error) {
+	config := make(map[string]map[string]string)
+	var section map[string]string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = make(map[string]string)
+			config[strings.TrimSpace(line[1:len(line)-1])] = section
+		case section != nil && strings.Contains(line, "="):
+			idx := strings.Index(line, "=")
+			section[strings.TrimSpace(line[:idx])] = strings.TrimSpace(line[idx+1:])
+		}
+	}
+	return config, scanner.Err()
+}
+
+//checkSharedRemote verify that the remote is defined in the shared config
+func checkSharedRemote(remote string) error {
+	name := remoteName(remote)
+	if name == "" {
+		return nil
+	}
+	sections, err := configSections(sharedConfigPath())
+	if err != nil {
+		return fmt.Errorf("no config option and unable to read shared config: %v", err)
+	}
+	if !sections[name] {
+		return fmt.Errorf("remote %s not found in shared config %s", name, sharedConfigPath())
+	}
+	return nil
+}
+
+//runtimeDir return the private runtime directory of a mountpoint
+func runtimeDir(mount string) string {
+	return filepath.Join(RuntimeFolder, mount)
+}
+
+//writeConfigFile decode the base64 rclone config and write it in a private file for the mountpoint
+func writeConfigFile(mount, config string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(config)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode config: %v", err)
+	}
+	dir := runtimeDir(mount)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, configFileName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+//shredConfigFile overwrite the config file of the mountpoint with zeros before removing it
+func shredConfigFile(mount string) error {
+	path := filepath.Join(runtimeDir(mount), configFileName)
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(make([]byte, fi.Size())); err != nil {
+		log.Warn().Err(err).Msgf("Unable to overwrite %s", path)
+	}
+	if err := f.Sync(); err != nil {
+		log.Warn().Err(err).Msgf("Unable to sync %s", path)
+	}
+	f.Close()
+	return os.Remove(path)
+}
+
+//removeRuntimeDir shred the config and remove the runtime directory of the mountpoint
+func removeRuntimeDir(mount string) error {
+	if err := shredConfigFile(mount); err != nil {
+		return err
+	}
+	return os.RemoveAll(runtimeDir(mount))
+}
+
+//redactOptions return a copy of volume options without the rclone config
+func redactOptions(opts map[string]string) map[string]string {
+	redacted := make(map[string]string, len(opts))
+	for k, val := range opts {
+		if k == "config" && val != "" {
+			val = "<redacted>"
+		} else if k == "remote" {
+			val = redactRemote(val)
+		}
+		redacted[k] = val
+	}
+	return redacted
+}
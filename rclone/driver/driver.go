@@ -3,17 +3,14 @@ package driver
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/sapk/docker-volume-helpers/tools"
 )
@@ -22,138 +19,308 @@ var (
 	//MountTimeout timeout before killing a mount try in seconds
 	MountTimeout = 30
 	//CfgVersion current config version compat
-	CfgVersion = 1
+	CfgVersion = 3
 	//CfgFolder config folder
 	CfgFolder = "/etc/docker-volumes/rclone/"
 )
 
 type rcloneMountpoint struct {
-	Path        string          `json:"path"`
-	Connections int             `json:"connections"`
-	Context     context.Context `json:"-"`
+	Path        string            `json:"path"`
+	Connections int               `json:"connections"`
+	IDs         map[string]string `json:"ids,omitempty"` //Docker mount ID -> volume name
+	PID         int               `json:"pid,omitempty"`
+	StartedAt   string            `json:"started_at,omitempty"`
+	Restarts    int               `json:"restarts,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	backoff     time.Duration     //Delay before next remount try
+	nextRetry   time.Time
+	pending     int        //Mount requests waiting for the mount
+	lock        sync.Mutex //Serialize mount operations, taken before the driver lock
 }
 
-func (m *rcloneMountpoint) isMounted() (bool, error) {
-	//TODO Better check for remote /var/lib/docker-volumes/rclone/mountpath fuse.rclone ro,nosuid,nodev,relatime,user_id=0,group_id=0 0 0
-	buf, err := ioutil.ReadFile("/proc/mounts")
-	if err != nil {
-		return false, err
-	}
-	log.Debug().Msgf("isMounted Path: path: %s %v", m.Path, strings.Contains(string(buf), " "+m.Path+" fuse.rclone"))
-	return strings.Contains(string(buf), " "+m.Path+" fuse.rclone"), nil
+//String return a representation of the mountpoint without its lock
+func (m *rcloneMountpoint) String() string {
+	return fmt.Sprintf("&{Path:%s Connections:%d IDs:%v PID:%d StartedAt:%s Restarts:%d LastError:%s}", m.Path, m.Connections, m.IDs, m.PID, m.StartedAt, m.Restarts, m.LastError)
 }
 
 type rcloneVolume struct {
-	Config      string `json:"config"`
-	Args        string `json:"args"`
-	Remote      string `json:"remote"`
-	Mount       string `json:"mount"`
-	Connections int    `json:"connections"`
-	CreatedAt   string `json:"created_at"`
+	Config        string            `json:"config"`
+	Args          string            `json:"args,omitempty"` //Legacy free-form flags, replaced by Options
+	Options       map[string]string `json:"options,omitempty"`
+	Remote        string            `json:"remote"`
+	Subpath       string            `json:"subpath,omitempty"`         //Folder of the remote exposed by the volume
+	CreateSubpath bool              `json:"create_subpath,omitempty"`  //Create the subpath on the remote at mount if missing
+	PurgeOnRemove bool              `json:"purge_on_remove,omitempty"` //Delete the remote path at removal of the volume
+	Mount         string            `json:"mount"`
+	Connections   int               `json:"connections"`
+	CreatedAt     string            `json:"created_at"`
+}
+
+//String return a representation of the volume without its config to keep secrets out of logs
+func (v *rcloneVolume) String() string {
+	return fmt.Sprintf("&{Remote:%s Subpath:%s Args:%s Options:%v Mount:%s Connections:%d CreatedAt:%s}", redactRemote(v.Remote), v.Subpath, v.Args, v.Options, v.Mount, v.Connections, v.CreatedAt)
+}
+
+//mountpoint return the path of the volume on the mountpoint (the subpath folder if set)
+func (v *rcloneVolume) mountpoint(m *rcloneMountpoint) string {
+	if v.Subpath == "" {
+		return m.Path
+	}
+	return filepath.Join(m.Path, v.Subpath)
+}
+
+//mountOptions return the validated rclone mount options of the volume including legacy args
+func (v *rcloneVolume) mountOptions() (map[string]string, error) {
+	opts, err := parseArgs(v.Args)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range v.Options {
+		if opts[key], err = validateOption(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
 }
 
 //RcloneDriver the global driver responding to call
 type RcloneDriver struct {
 	sync.RWMutex
-	root       string
-	persitence *viper.Viper
-	volumes    map[string]*rcloneVolume
-	mounts     map[string]*rcloneMountpoint
+	root     string
+	volumes  map[string]*rcloneVolume
+	mounts   map[string]*rcloneMountpoint
+	store    Store
+	mounter  Mounter
+	ctx      context.Context //Cancelled by Close to abort external operations in progress
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	mounting singleflight.Group //Coalesce concurrent mounts of a mountpoint
+	creating sync.Mutex         //Serialize creations as the shared store is accessed outside of the driver lock
+	health   healthProbes       //Stats of mount paths in progress and their last result
+	//saveLock keep the writes of the persistence file in order, saveGeneration numbers the encoded states
+	saveLock        sync.Mutex
+	saveGeneration  uint64
+	savedGeneration uint64
 }
 
-//Init start all needed deps and serve response to API call
-func Init(root string) *RcloneDriver {
+//Option customize the driver at init
+type Option func(*RcloneDriver)
+
+//WithStore share volume definitions between nodes through the store (global scope)
+func WithStore(s Store) Option {
+	return func(d *RcloneDriver) {
+		d.store = s
+	}
+}
+
+//newDriver return an empty driver configured by options
+func newDriver(root string, options ...Option) *RcloneDriver {
 	d := &RcloneDriver{
-		root:       root,
-		persitence: viper.New(),
-		volumes:    make(map[string]*rcloneVolume),
-		mounts:     make(map[string]*rcloneMountpoint),
+		root:    root,
+		volumes: make(map[string]*rcloneVolume),
+		mounts:  make(map[string]*rcloneMountpoint),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, option := range options {
+		option(d)
 	}
+	if d.mounter == nil {
+		d.mounter = NewProcessMounter()
+	}
+	return d
+}
+
+//Init start all needed deps and serve response to API call
+func Init(root string, options ...Option) (*RcloneDriver, error) {
+	d := newDriver(root, options...)
 
-	d.persitence.SetDefault("volumes", map[string]*rcloneVolume{})
-	d.persitence.SetConfigName("persistence")
-	d.persitence.SetConfigType("json")
-	d.persitence.AddConfigPath(CfgFolder)
-	if err := d.persitence.ReadInConfig(); err != nil { // Handle errors reading the config file
+	p, migrated, err := loadConfig()
+	if os.IsNotExist(err) {
 		log.Warn().Err(err).Msg("No persistence file found, I will start with a empty list of volume")
+	} else if unrecoverable(err) {
+		return nil, err
+	} else if err != nil {
+		log.Error().Err(err).Msg("Unable to read persistence, I will start with a empty list of volume")
+		setAsideCorruptConfig()
 	} else {
 		log.Debug().Msg("Retrieving volume list from persistence file.")
-
-		var version int
-		err := d.persitence.UnmarshalKey("version", &version)
-		if err != nil || version != CfgVersion {
-			log.Warn().Err(err).Msg("Unable to decode version of persistence")
-			d.volumes = make(map[string]*rcloneVolume)
-			d.mounts = make(map[string]*rcloneMountpoint)
-		} else { //We have the same version
-			err := d.persitence.UnmarshalKey("volumes", &d.volumes)
-			if err != nil {
-				log.Warn().Err(err).Msg("Unable to decode into struct -> start with empty list")
-				d.volumes = make(map[string]*rcloneVolume)
-			}
-			err = d.persitence.UnmarshalKey("mounts", &d.mounts)
-			if err != nil {
-				log.Warn().Err(err).Msg("Unable to decode into struct -> start with empty list")
-				d.mounts = make(map[string]*rcloneMountpoint)
+		if p.Volumes != nil {
+			d.volumes = p.Volumes
+		}
+		if p.Mounts != nil {
+			d.mounts = p.Mounts
+		}
+		if migrated {
+			if err := d.saveConfig(); err != nil {
+				return nil, err
 			}
 		}
+		d.reconcile()
 	}
-	return d
+	d.refresh()
+	d.startWatchdog()
+	return d, nil
 }
 
 //Create create and init the requested volume
+//The shared store is read and written outside of the driver lock as it can be remote.
 func (d *RcloneDriver) Create(r *volume.CreateRequest) error {
-	log.Debug().Msgf("Entering Create: name: %s, options %v", r.Name, r.Options)
+	log.Debug().Msgf("Entering Create: name: %s, options %v", r.Name, redactOptions(r.Options))
+	d.creating.Lock()
+	defer d.creating.Unlock()
+
+	v, err := d.newVolume(r)
+	if err != nil {
+		return err
+	}
+	d.RLock()
+	old, exists := d.volumes[r.Name]
+	d.RUnlock()
+	if exists {
+		return checkSameVolume(r.Name, old, v, "")
+	}
+	stored, err := d.storedVolume(r.Name)
+	if err != nil {
+		return fmt.Errorf("unable to read volume %s from shared store: %v", r.Name, err)
+	}
+	if stored != nil {
+		if err := checkSameVolume(r.Name, stored, v, " in shared store"); err != nil {
+			return err
+		}
+		log.Debug().Msgf("Volume %s taken from shared store", r.Name)
+		v = stored //Created by another node
+	} else if err := d.storeVolume(r.Name, v); err != nil {
+		return fmt.Errorf("unable to publish volume %s in shared store: %v", r.Name, err)
+	}
+
 	d.Lock()
-	defer d.Unlock()
+	created, err := d.addVolume(r.Name, v)
+	d.Unlock()
+	if err != nil || !created {
+		return err
+	}
+	return d.saveConfig()
+}
+
+//newVolume validate the options of the request and return the volume they define
+func (d *RcloneDriver) newVolume(r *volume.CreateRequest) (*rcloneVolume, error) {
+	if r.Options == nil || r.Options["remote"] == "" {
+		return nil, fmt.Errorf("remote option required")
+	}
+	if r.Options["config"] == "" {
+		if err := checkSharedRemote(r.Options["remote"]); err != nil {
+			return nil, err
+		}
+	}
 
-	if r.Options == nil || r.Options["config"] == "" || r.Options["remote"] == "" {
-		return fmt.Errorf("config and remote option required")
+	opts, err := parseVolumeOptions(r.Options)
+	if err != nil {
+		return nil, err
+	}
+	subpath, createSub, err := parseSubpath(r.Options)
+	if err != nil {
+		return nil, err
 	}
+	purge, err := parseBoolOption(r.Options, "purge_on_remove")
+	if err != nil {
+		return nil, err
+	}
+	return &rcloneVolume{
+		Config:        r.Options["config"],
+		Remote:        r.Options["remote"],
+		Subpath:       subpath,
+		CreateSubpath: createSub,
+		PurgeOnRemove: purge,
+		Options:       opts,
+		Mount:         GetMountName(d, r),
+		Connections:   0,
+		CreatedAt:     time.Now().Format(time.RFC3339),
+	}, nil
+}
 
-	v := &rcloneVolume{
-		Config:      r.Options["config"],
-		Remote:      r.Options["remote"],
-		Args:        r.Options["args"],
-		Mount:       GetMountName(d, r),
+//checkSameVolume refuse a creation redefining an existing volume
+func checkSameVolume(name string, old, v *rcloneVolume, where string) error {
+	if old.Mount == v.Mount && old.Subpath == v.Subpath && old.CreateSubpath == v.CreateSubpath && old.PurgeOnRemove == v.PurgeOnRemove {
+		return nil
+	}
+	return fmt.Errorf("volume %s already exists%s with a different definition", name, where)
+}
+
+//addVolume add the volume to the state and return false if it already exists with the same definition
+//It must be called with the driver lock held.
+func (d *RcloneDriver) addVolume(name string, v *rcloneVolume) (bool, error) {
+	if old, ok := d.volumes[name]; ok { //Added from the shared store in the meantime
+		return false, checkSameVolume(name, old, v, "")
+	}
+	if _, err := d.ensureMountpoint(v.Mount); err != nil {
+		return false, err
+	}
+	d.volumes[name] = v
+	log.Debug().Msgf("Volume Created: %v", v)
+	return true, nil
+}
+
+//ensureMountpoint return the mountpoint or create it if it doesn't allready exist
+func (d *RcloneDriver) ensureMountpoint(mount string) (*rcloneMountpoint, error) {
+	if m, ok := d.mounts[mount]; ok {
+		return m, nil
+	}
+	m := &rcloneMountpoint{
+		Path:        filepath.Join(d.root, mount),
 		Connections: 0,
-		CreatedAt:   time.Now().Format(time.RFC3339),
 	}
 
-	if _, ok := d.mounts[v.Mount]; !ok { //This mountpoint doesn't allready exist -> create it
-		m := &rcloneMountpoint{
-			Path:        filepath.Join(d.root, v.Mount),
-			Connections: 0,
+	_, err := os.Lstat(m.Path) //Create folder if not exist. This will also failed if already exist
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(m.Path, 0700); err != nil {
+			return nil, err
 		}
+	} else if err != nil {
+		return nil, err
+	}
+	isempty, err := tools.FolderIsEmpty(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !isempty {
+		return nil, fmt.Errorf("%v already exist and is not empty", m.Path)
+	}
+	d.mounts[mount] = m
+	return m, nil
+}
 
-		_, err := os.Lstat(m.Path) //Create folder if not exist. This will also failed if already exist
-		if os.IsNotExist(err) {
-			if err = os.MkdirAll(m.Path, 0700); err != nil {
-				return err
-			}
-		} else if err != nil {
-			return err
-		}
-		isempty, err := tools.FolderIsEmpty(m.Path)
-		if err != nil {
-			return err
-		}
-		if !isempty {
-			return fmt.Errorf("%v already exist and is not empty", m.Path)
+//refresh sync volumes from the shared store in global scope
+func (d *RcloneDriver) refresh() {
+	if d.store == nil {
+		return
+	}
+	values, err := d.store.List() //Outside of lock as the store can be remote
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to list shared store, using local state")
+		return
+	}
+	d.Lock()
+	changed, orphans := d.syncStore(values)
+	d.Unlock()
+	if !changed {
+		return
+	}
+	for _, mount := range orphans {
+		if err := d.removeOrphanMount(mount); err != nil {
+			log.Warn().Err(err).Msgf("Unable to remove mountpoint %s", mount)
 		}
-		d.mounts[v.Mount] = m
 	}
-
-	d.volumes[r.Name] = v
-	log.Debug().Msgf("Volume Created: %v", v)
-	return d.saveConfig()
+	if err := d.saveConfig(); err != nil {
+		log.Warn().Err(err).Msg("Unable to save state synced from shared store")
+	}
 }
 
 //List volumes handled by the driver
 func (d *RcloneDriver) List() (*volume.ListResponse, error) {
 	log.Debug().Msgf("Entering List")
-	d.Lock()
-	defer d.Unlock()
+	d.refresh()
+	d.RLock()
+	defer d.RUnlock()
 
 	var vols []*volume.Volume
 	for name, v := range d.volumes {
@@ -163,7 +330,7 @@ func (d *RcloneDriver) List() (*volume.ListResponse, error) {
 			return nil, fmt.Errorf("volume mount %s not found for %s", v.Mount, v.Remote)
 		}
 		log.Debug().Msgf("Mount found: %v", m)
-		vols = append(vols, &volume.Volume{Name: name, Mountpoint: m.Path, CreatedAt: v.CreatedAt})
+		vols = append(vols, &volume.Volume{Name: name, Mountpoint: v.mountpoint(m), CreatedAt: v.CreatedAt})
 	}
 	return &volume.ListResponse{Volumes: vols}, nil
 }
@@ -171,72 +338,229 @@ func (d *RcloneDriver) List() (*volume.ListResponse, error) {
 //Get get info on the requested volume
 func (d *RcloneDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
 	log.Debug().Msgf("Entering Get: name: %s", r.Name)
-	d.Lock()
-	defer d.Unlock()
+	d.refresh()
+	vol, err := d.volumeInfo(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &volume.GetResponse{Volume: vol}, nil
+}
 
-	v, ok := d.volumes[r.Name]
+//volumeInfo describe the volume with its status and the health of its mountpoint
+func (d *RcloneDriver) volumeInfo(name string) (*volume.Volume, error) {
+	d.RLock()
+	v, ok := d.volumes[name]
 	if !ok {
-		return nil, fmt.Errorf("volume %s not found", r.Name)
+		d.RUnlock()
+		return nil, fmt.Errorf("volume %s not found", name)
 	}
 	log.Debug().Msgf("Volume found: %v", v)
 
 	m, ok := d.mounts[v.Mount]
 	if !ok {
-		return nil, fmt.Errorf("volume mount %s not found for %s", v.Mount, r.Name)
+		d.RUnlock()
+		return nil, fmt.Errorf("volume mount %s not found for %s", v.Mount, name)
 	}
 	log.Debug().Msgf("Mount found: %v", m)
 
-	return &volume.GetResponse{Volume: &volume.Volume{Name: r.Name, Mountpoint: m.Path, CreatedAt: v.CreatedAt}}, nil
+	vol := &volume.Volume{Name: name, Mountpoint: v.mountpoint(m), CreatedAt: v.CreatedAt, Status: d.volumeStatus(name, v, m)}
+	path := m.Path
+	d.RUnlock()
+
+	d.addHealthStatus(vol.Status, path) //Outside of lock as a hung mount can block
+	if p, ok := d.mounter.(vfsStatsProvider); ok && vol.Status["health"] == mountHealthy.String() {
+		if stats, err := p.vfsStats(path); err != nil {
+			vol.Status["vfs_error"] = err.Error()
+		} else {
+			vol.Status["vfs"] = stats
+		}
+	}
+	return vol, nil
 }
 
 //Remove remove the requested volume
 func (d *RcloneDriver) Remove(r *volume.RemoveRequest) error {
 	log.Debug().Msgf("Entering Remove: name: %s", r.Name)
-	d.Lock()
-	defer d.Unlock()
-	v, ok := d.volumes[r.Name]
+	d.refresh()
+	return d.removeVolume(r.Name, false)
+}
+
+//lookup return the volume and its mountpoint
+//It must be called with the driver lock held.
+func (d *RcloneDriver) lookup(name string) (*rcloneVolume, *rcloneMountpoint, error) {
+	v, ok := d.volumes[name]
 	if !ok {
-		return fmt.Errorf("volume %s not found", r.Name)
+		return nil, nil, fmt.Errorf("volume %s not found", name)
 	}
 	log.Debug().Msgf("Volume found: %v", v)
 
 	m, ok := d.mounts[v.Mount]
 	if !ok {
-		return fmt.Errorf("volume mount %s not found for %s", v.Mount, r.Name)
+		return nil, nil, fmt.Errorf("volume mount %s not found for %s", v.Mount, name)
 	}
 	log.Debug().Msgf("Mount found: %v", m)
+	return v, m, nil
+}
+
+//lockMountpoint take the lock of the mountpoint of the volume and return them with the unlock function
+//The lookup is checked again once locked as the volume can be removed while waiting.
+func (d *RcloneDriver) lockMountpoint(name string) (*rcloneVolume, *rcloneMountpoint, func(), error) {
+	d.RLock()
+	v, m, err := d.lookup(name)
+	d.RUnlock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	m.lock.Lock()
+	d.RLock()
+	defer d.RUnlock()
+	if d.volumes[name] != v || d.mounts[v.Mount] != m {
+		m.lock.Unlock()
+		return nil, nil, nil, fmt.Errorf("volume %s changed while waiting for its mountpoint", name)
+	}
+	return v, m, m.lock.Unlock, nil
+}
 
-	//Unmount
-	mounted, err := m.isMounted()
+//removeVolume forget the volume and tear down its mountpoint if not shared with other volumes
+//It refuses if containers use the volume unless forced, their references are then forgotten.
+//It must be called without the driver lock held.
+func (d *RcloneDriver) removeVolume(name string, force bool) error {
+	v, m, unlock, err := d.lockMountpoint(name)
 	if err != nil {
 		return err
 	}
-	if mounted { //Only if mounted
-		if _, err := d.runCmd(fmt.Sprintf(`umount -l "%s"`, m.Path)); err != nil {
-			time.Sleep(15 * time.Second) //Wait a little adn force unmount
-			if _, err := d.runCmd(fmt.Sprintf(`umount -f "%s"`, m.Path)); err != nil {
-				return err
-			}
-		}
-		if m.Context != nil {
-			m.Context.Done()
+	defer unlock()
+
+	d.RLock()
+	refs := m.volumeRefs(name)
+	shared := len(d.mountVolumes(v.Mount)) > 1
+	stop := !shared || len(refs) == len(m.IDs) //Unmount if no other volume use it
+	d.RUnlock()
+	if len(refs) > 0 && !force {
+		return fmt.Errorf("volume %s is in use by %d containers", name, len(refs))
+	}
+	var purge string
+	if v.PurgeOnRemove {
+		d.RLock()
+		target, err := d.purgeTarget(name, v)
+		d.RUnlock()
+		if err != nil {
+			return err
 		}
+		purge = target
 	}
 
-	if _, err := os.Stat(m.Path); !os.IsNotExist(err) {
-		//Remove mount point
-		if err := os.Remove(m.Path); err != nil {
+	if !shared {
+		if err := d.teardownMountpoint(v, m); err != nil {
+			return err
+		}
+	} else if stop {
+		if err := d.stopMount(v, m); err != nil {
+			return err
+		}
+	}
+	if purge != "" {
+		if err := purgeRemote(d.ctx, v.Mount, purge, v.Config); err != nil {
+			if !shared { //The volume is kept, restore its mountpoint folder so it can still be mounted
+				if errDir := os.MkdirAll(m.Path, 0700); errDir != nil {
+					log.Warn().Err(errDir).Msgf("Unable to restore mountpoint %s", m.Path)
+				}
+			}
 			return err
 		}
 	}
-	delete(d.mounts, v.Mount)
-	delete(d.volumes, r.Name)
+
+	if err := d.unstoreVolume(name); err != nil { //Outside of lock as the store can be remote
+		return fmt.Errorf("unable to remove volume %s from shared store: %v", name, err)
+	}
+	d.Lock()
+	err = d.forgetVolume(name, v, m, refs, shared)
+	d.Unlock()
+	if err != nil {
+		return err
+	}
 	return d.saveConfig()
 }
 
+//forgetVolume drop the volume and its references from the state
+//It must be called with the driver lock held.
+func (d *RcloneDriver) forgetVolume(name string, v *rcloneVolume, m *rcloneMountpoint, refs []string, shared bool) error {
+	for _, id := range refs {
+		m.removeRef(id, name)
+	}
+	delete(d.volumes, name)
+	if !shared {
+		if len(d.mountVolumes(v.Mount)) == 0 {
+			delete(d.mounts, v.Mount)
+		} else if err := os.MkdirAll(m.Path, 0700); err != nil { //Reused by a volume created meanwhile
+			return err
+		}
+	}
+	d.updateConnections(v.Mount)
+	return nil
+}
+
+//removeOrphanMount tear down the mountpoint if no volume use it anymore
+func (d *RcloneDriver) removeOrphanMount(mount string) error {
+	d.RLock()
+	m, ok := d.mounts[mount]
+	d.RUnlock()
+	if !ok {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return d.dropMountpoint(mount, m)
+}
+
+//dropMountpoint tear down the mountpoint and forget it if still without volume
+//It must be called with the mountpoint lock held.
+func (d *RcloneDriver) dropMountpoint(mount string, m *rcloneMountpoint) error {
+	d.RLock()
+	orphan := d.mounts[mount] == m && len(d.mountVolumes(mount)) == 0
+	d.RUnlock()
+	if !orphan {
+		return nil
+	}
+	if err := d.teardownMountpoint(&rcloneVolume{Mount: mount}, m); err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if len(d.mountVolumes(mount)) == 0 {
+		delete(d.mounts, mount)
+	}
+	return nil
+}
+
+//teardownMountpoint unmount the mountpoint, verify nothing is mounted anymore on its path and remove it
+//The path is only removed if empty so files of the remote can never be deleted through a live mount.
+//It must be called with the mountpoint lock held, the caller forget the mountpoint.
+func (d *RcloneDriver) teardownMountpoint(v *rcloneVolume, m *rcloneMountpoint) error {
+	if err := d.stopMount(v, m); err != nil {
+		return err
+	}
+	mi, err := findMount(m.Path)
+	if err != nil {
+		return fmt.Errorf("unable to verify that %s is unmounted: %v", m.Path, err)
+	}
+	if mi != nil {
+		return fmt.Errorf("%s is still mounted (%s), not removing it", m.Path, mi.FSType)
+	}
+	closeMountLog(v.Mount)
+	if err := removeRuntimeDir(v.Mount); err != nil {
+		return err
+	}
+	if err := os.Remove(m.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 //Path get path of the requested volume
 func (d *RcloneDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
 	log.Debug().Msgf("Entering Path: name: %s", r.Name)
+	d.refresh()
 	d.RLock()
 	defer d.RUnlock()
 
@@ -252,119 +576,195 @@ func (d *RcloneDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error)
 	}
 	log.Debug().Msgf("Mount found: %v", m)
 
-	return &volume.PathResponse{Mountpoint: m.Path}, nil
+	return &volume.PathResponse{Mountpoint: v.mountpoint(m)}, nil
 }
 
 //Mount mount the requested volume
+//Only the mountpoint is locked while mounting so other volumes and read-only calls are not blocked.
 func (d *RcloneDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
 	log.Debug().Msgf("Entering Mount: %v", r)
+	d.refresh()
 	d.Lock()
-	defer d.Unlock()
-
-	v, ok := d.volumes[r.Name]
-	if !ok {
-		return nil, fmt.Errorf("volume %s not found", r.Name)
+	v, m, err := d.lookup(r.Name)
+	if err != nil {
+		d.Unlock()
+		return nil, err
 	}
-
-	m, ok := d.mounts[v.Mount]
-	if !ok {
-		return nil, fmt.Errorf("volume mount %s not found for %s", v.Mount, r.Name)
+	added := m.addRef(r.ID, r.Name) //Registered before mounting so a concurrent unmount keeps the mount
+	if !added {
+		log.Debug().Msgf("Mount %s already registered for %s", r.ID, r.Name)
+	}
+	m.pending++
+	d.updateConnections(v.Mount)
+	d.Unlock()
+
+	err = d.ensureMounted(r.Name, v, m)
+	mounted := err == nil
+	if mounted {
+		err = v.checkSubpath(m)
 	}
 
-	ready, err := m.isMounted()
+	d.Lock()
+	m.pending--
+	if err != nil && added {
+		m.removeRef(r.ID, r.Name)
+	}
+	d.updateConnections(v.Mount)
+	d.Unlock()
 	if err != nil {
+		if !mounted {
+			return nil, err
+		}
+		if errStop := d.releaseMount(v, m); errStop != nil { //Mounted only for this request
+			log.Warn().Err(errStop).Msgf("Unable to unmount %s", m.Path)
+		}
+		return nil, err
+	}
+
+	if err := d.saveConfig(); err != nil {
 		return nil, err
 	}
-	if ready {
-		v.Connections++
-		m.Connections++
-		if err := d.saveConfig(); err != nil {
+	d.RLock()
+	defer d.RUnlock()
+	return &volume.MountResponse{Mountpoint: v.mountpoint(m)}, nil
+}
+
+//ensureMounted mount the mountpoint if not already mounted
+//Concurrent calls for the same mountpoint share a single mount try and its result.
+func (d *RcloneDriver) ensureMounted(name string, v *rcloneVolume, m *rcloneMountpoint) error {
+	_, err, _ := d.mounting.Do(v.Mount, func() (interface{}, error) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		d.RLock()
+		current := d.mounts[v.Mount] == m
+		d.RUnlock()
+		if !current {
+			return nil, fmt.Errorf("volume mount %s removed while mounting %s", v.Mount, name)
+		}
+		ready, err := d.isMounted(m)
+		if err != nil || ready {
 			return nil, err
 		}
-		return &volume.MountResponse{Mountpoint: m.Path}, nil
-	}
+		return nil, d.startMount(name, v, m)
+	})
+	return err
+}
 
-	//If not
-	//Reset (maybe a reboot)
-	v.Connections = 0
-	m.Connections = 0
+//releaseMount unmount the mountpoint if no container use it anymore
+func (d *RcloneDriver) releaseMount(v *rcloneVolume, m *rcloneMountpoint) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d.RLock()
+	unused := len(m.IDs) == 0 && d.mounts[v.Mount] == m
+	d.RUnlock()
+	if !unused {
+		return nil
+	}
+	return d.stopMount(v, m)
+}
 
-	//TODO write temp file before and don't use base64
-	//TODO locate rclone binary (/usr/bin/rclone, /usr/local/bin/rclone)
-	var cmd string
-	if zerolog.GlobalLevel() == zerolog.DebugLevel {
-		cmd = fmt.Sprintf("/usr/bin/rclone --log-file /var/log/rclone.%d.log --config=<(echo \"%s\"| base64 -d) %s mount \"%s\" \"%s\" & sleep 5s", time.Now().Unix(), v.Config, v.Args, v.Remote, m.Path)
-	} else {
-		cmd = fmt.Sprintf("/usr/bin/rclone --config=<(echo \"%s\"| base64 -d) %s mount \"%s\" \"%s\" & sleep 5s", v.Config, v.Args, v.Remote, m.Path)
+//checkSubpath verify that the subpath of the volume exists on the mounted remote or create it if requested
+func (v *rcloneVolume) checkSubpath(m *rcloneMountpoint) error {
+	if v.Subpath == "" {
+		return nil
+	}
+	path := v.mountpoint(m)
+	if v.CreateSubpath {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("unable to create subpath %s: %v", v.Subpath, err)
+		}
+		return nil
 	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("subpath %s not found on remote (set create_subpath to create it)", v.Subpath)
+	} else if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("subpath %s is not a folder", v.Subpath)
+	}
+	return nil
+}
 
-	m.Context, err = d.runCmd(cmd)
+//isMounted check if the mountpoint is mounted by rclone
+func (d *RcloneDriver) isMounted(m *rcloneMountpoint) (bool, error) {
+	mounted, err := d.mounter.IsMounted(m.Path)
+	log.Debug().Msgf("isMounted Path: path: %s %v", m.Path, mounted)
+	return mounted, err
+}
+
+//startMount mount the volume on the mountpoint and wait for it to be ready
+//It must be called with the mountpoint lock held but not the driver lock as mounting is slow.
+func (d *RcloneDriver) startMount(name string, v *rcloneVolume, m *rcloneMountpoint) (err error) {
+	start := time.Now()
+	defer func() {
+		observeDuration(mountDuration, start, err)
+		if err != nil {
+			mountFailures.WithLabelValues(failureReason(err)).Inc()
+		}
+	}()
+	opts, err := v.mountOptions()
 	if err != nil {
-		return nil, err
+		return &optionsError{Volume: name, Err: err}
 	}
-
-	/* TODO test more this before using it.
-	cmdCheck := fmt.Sprintf("mount | grep %s > /dev/null", m.Path)
-	folderMounted := false
-	for !folderMounted {
-		log.Debug().Msgf("Waiting for mount: %s", m.Path)
-		time.Sleep(5 * time.Second)
-		folderMounted = (nil == d.runCmd(cmdCheck))
+	if err := d.mounter.Mount(d.ctx, mountSpec(name, v, m, opts)); err != nil {
+		return err
+	}
+	pid, startedAt := 0, time.Now()
+	if p := d.process(m); p != nil {
+		pid, startedAt = p.PID(), p.StartedAt()
 	}
-	*/
-	//Temporary fix
-	time.Sleep(15 * time.Second)
+	d.Lock()
+	defer d.Unlock()
+	m.PID = pid
+	m.StartedAt = startedAt.Format(time.RFC3339)
+	return nil
+}
 
-	v.Connections++
-	m.Connections++
-	if err := d.saveConfig(); err != nil {
-		return nil, err
+//stopMount unmount the mountpoint and release its resources (process, config, ...)
+//It must be called with the mountpoint lock held but not the driver lock.
+func (d *RcloneDriver) stopMount(v *rcloneVolume, m *rcloneMountpoint) error {
+	start := time.Now()
+	err := d.mounter.Unmount(d.ctx, mountSpec("", v, m, nil))
+	observeDuration(unmountDuration, start, err)
+	if err != nil {
+		return err
 	}
-	return &volume.MountResponse{Mountpoint: m.Path}, nil
+	d.Lock()
+	defer d.Unlock()
+	m.PID = 0
+	m.StartedAt = ""
+	m.backoff = 0
+	m.nextRetry = time.Time{}
+	return nil
 }
 
 //Unmount unmount the requested volume
 func (d *RcloneDriver) Unmount(r *volume.UnmountRequest) error {
 	log.Debug().Msgf("Entering Unmount: %v", r)
 	d.Lock()
-	defer d.Unlock()
-
-	v, ok := d.volumes[r.Name]
-	if !ok {
-		return fmt.Errorf("volume %s not found", r.Name)
-	}
-
-	m, ok := d.mounts[v.Mount]
-	if !ok {
-		return fmt.Errorf("volume mount %s not found for %s", v.Mount, r.Name)
-	}
-
-	mounted, err := m.isMounted()
+	v, m, err := d.lookup(r.Name)
 	if err != nil {
+		d.Unlock()
 		return err
 	}
-	if !mounted { //Force reset if not mounted
-		m.Connections = 0
-		v.Connections = 0
-	} else {
-		if m.Connections <= 1 {
-			if _, err := d.runCmd(fmt.Sprintf(`umount -l "%s"`, m.Path)); err != nil {
-				time.Sleep(15 * time.Second) //Wait a little adn force unmount
-				if _, err := d.runCmd(fmt.Sprintf(`umount -f "%s"`, m.Path)); err != nil {
-					return err
-				}
-			}
-			if m.Context != nil {
-				m.Context.Done()
-			}
-			m.Connections = 0
-			v.Connections = 0
-		} else {
-			m.Connections--
-			v.Connections--
+	known := m.removeRef(r.ID, r.Name)
+	if !known {
+		log.Warn().Msgf("Unmount of unknown mount id %s for %s", r.ID, r.Name)
+	}
+	d.updateConnections(v.Mount)
+	d.Unlock()
+
+	if err := d.releaseMount(v, m); err != nil {
+		if known {
+			d.Lock()
+			m.addRef(r.ID, r.Name)
+			d.updateConnections(v.Mount)
+			d.Unlock()
 		}
+		return err
 	}
-
 	return d.saveConfig()
 }
 
@@ -373,7 +773,7 @@ func (d *RcloneDriver) Capabilities() *volume.CapabilitiesResponse {
 	log.Debug().Msgf("Entering Capabilities")
 	return &volume.CapabilitiesResponse{
 		Capabilities: volume.Capability{
-			Scope: "local",
+			Scope: Scope,
 		},
 	}
 }
@@ -2,7 +2,9 @@ package driver_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -10,9 +12,12 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 
 	"github.com/sapk/docker-volume-rclone/rclone"
 	"github.com/sapk/docker-volume-rclone/rclone/driver"
@@ -20,10 +25,20 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+func TestMain(m *testing.M) {
+	driver.WatchdogInterval = 0 //Not exercised, it would read the globals changed by the tests
+	os.Exit(m.Run())
+}
+
 func TestInit(t *testing.T) {
-	d := driver.Init("/tmp/test-root")
+	d, err := driver.Init("/tmp/test-root")
+	if err != nil {
+		t.Error("Expected no error, got ", err)
+	}
 	if d == nil {
 		t.Error("Expected to be not null, got ", d)
+	} else {
+		defer d.Close()
 	}
 	/*
 		  if _, err := os.Stat(cfgFolder + "gluster-persistence.json"); err != nil {
@@ -33,16 +48,268 @@ func TestInit(t *testing.T) {
 }
 
 func TestMountName(t *testing.T) {
-	name := driver.GetMountName(&driver.RcloneDriver{}, &volume.CreateRequest{
-		Name: "test",
-		Options: map[string]string{
-			"remote": "some-remote:bucket/",
-		},
-	})
+	mountName := func(name string, options map[string]string) string {
+		return driver.GetMountName(&driver.RcloneDriver{}, &volume.CreateRequest{Name: name, Options: options})
+	}
+	name := mountName("test", map[string]string{"remote": "some-remote:bucket/"})
+	assert.Regexp(t, "^[0-9a-f]{16}$", name)
+	assert.Equal(t, name, mountName("other", map[string]string{"remote": "some-remote:bucket/"}), "same definition")
+	assert.NotEqual(t, name, mountName("test", map[string]string{"remote": "some-remote:other/"}), "other remote")
+	assert.NotEqual(t, name, mountName("test", map[string]string{"remote": "some-remote:bucket/", "config": "W3Rlc3RpbmddCg=="}), "other config")
+	assert.NotEqual(t, name, mountName("test", map[string]string{"remote": "some-remote:bucket/", "read_only": "true"}), "other flags")
+	assert.Equal(t, mountName("test", map[string]string{"remote": "some-remote:bucket/", "uid": "33", "allow_other": ""}),
+		mountName("test", map[string]string{"remote": "some-remote:bucket/", "args": "--allow-other --uid=33"}), "same effective flags")
+}
+
+func TestCreateOptions(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	d, err := driver.Init(t.TempDir())
+	assert.NoError(t, err)
+	defer d.Close()
+
+	tests := []struct {
+		name    string
+		options map[string]string
+		err     string
+	}{
+		{"typed", map[string]string{"uid": "33", "gid": "33", "umask": "022", "allow_other": "true", "vfs_cache_mode": "writes", "dir_cache_time": "5m", "buffer_size": "16M"}, ""},
+		{"bool-no-value", map[string]string{"read_only": ""}, ""},
+		{"args", map[string]string{"args": "--uid 1001 --gid=1001 --allow-root --allow-other --fast-list"}, ""},
+		{"args-quoted", map[string]string{"args": `--dir-cache-time "1h30m"`}, ""},
+		{"unknown-option", map[string]string{"foo": "bar"}, "unsupported option foo"},
+		{"invalid-int", map[string]string{"uid": "-1"}, `invalid positive integer "-1" for option uid`},
+		{"invalid-octal", map[string]string{"umask": "089"}, `invalid octal "089" for option umask`},
+		{"invalid-bool", map[string]string{"read_only": "maybe"}, `invalid boolean "maybe" for option read_only`},
+		{"invalid-duration", map[string]string{"dir_cache_time": "5 minutes"}, `invalid duration "5 minutes" for option dir_cache_time`},
+		{"invalid-size", map[string]string{"buffer_size": "big"}, `invalid size "big" for option buffer_size`},
+		{"invalid-enum", map[string]string{"vfs_cache_mode": "all"}, `invalid value "all" for option vfs_cache_mode (allowed: off, minimal, writes, full)`},
+		{"args-dangerous-flag", map[string]string{"args": "--config /etc/passwd"}, "unsupported flag --config in args"},
+		{"args-injection", map[string]string{"args": "; rm -rf /"}, `unexpected argument ";" in args`},
+		{"args-missing-value", map[string]string{"args": "--uid"}, "missing value for flag --uid in args"},
+		{"args-unterminated", map[string]string{"args": `--uid "33`}, "unterminated quote or escape in args"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.options["config"] = "W3Rlc3RpbmddCnR5cGUgPSBsb2NhbAoK"
+			tt.options["remote"] = "testing:/tmp"
+			err := d.Create(&volume.CreateRequest{Name: tt.name, Options: tt.options})
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCreateSharedConfig(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	assert.NoError(t, os.MkdirAll(driver.CfgFolder, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(driver.CfgFolder, "rclone.conf"), []byte("[testing]\ntype = local\n\n"), 0600))
+	d, err := driver.Init(t.TempDir())
+	assert.NoError(t, err)
+	defer d.Close()
+
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "shared", Options: map[string]string{"remote": "testing:/tmp"}}))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "on-the-fly", Options: map[string]string{"remote": ":local:/tmp"}}))
+	assert.EqualError(t, d.Create(&volume.CreateRequest{Name: "unknown", Options: map[string]string{"remote": "unknown:/tmp"}}),
+		"remote unknown not found in shared config "+filepath.Join(driver.CfgFolder, "rclone.conf"))
+}
+
+func TestPersistenceBackup(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	root := t.TempDir()
+	options := map[string]string{"config": "W3Rlc3RpbmddCnR5cGUgPSBsb2NhbAoK", "remote": "testing:/tmp"}
+	d, err := driver.Init(root)
+	assert.NoError(t, err)
+	defer d.Close()
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "first", Options: options}))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "second", Options: options}))
+
+	persistence := filepath.Join(driver.CfgFolder, "persistence.json")
+	assert.FileExists(t, persistence+".bak")
+
+	//Simulate a truncated write
+	assert.NoError(t, ioutil.WriteFile(persistence, []byte(`{"version":1,"volu`), 0600))
+	d, err = driver.Init(root)
+	assert.NoError(t, err)
+	defer d.Close()
+	resp, err := d.Get(&volume.GetRequest{Name: "first"})
+	assert.NoError(t, err)
+	assert.Equal(t, "first", resp.Volume.Name)
+
+	//Both unreadable: start empty but keep files aside
+	assert.NoError(t, ioutil.WriteFile(persistence, []byte(`{"version":1,"volu`), 0600))
+	assert.NoError(t, ioutil.WriteFile(persistence+".bak", []byte(`{`), 0600))
+	d, err = driver.Init(root)
+	assert.NoError(t, err)
+	defer d.Close()
+	list, err := d.List()
+	assert.NoError(t, err)
+	assert.Empty(t, list.Volumes)
+	matches, err := filepath.Glob(persistence + "*.corrupt-*")
+	assert.NoError(t, err)
+	assert.Len(t, matches, 2)
+}
+
+func TestPersistenceMigration(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	assert.NoError(t, os.MkdirAll(driver.CfgFolder, 0700))
+	persistence := filepath.Join(driver.CfgFolder, "persistence.json")
+	v1 := `{"version":1,"volumes":{"foo":{"config":"W3Rlc3RpbmddCnR5cGUgPSBsb2NhbAoK","args":"--uid 33 --allow-other","remote":"testing:/tmp","mount":"foo","connections":0,"created_at":"2020-11-11T00:00:00Z"}},"mounts":{"foo":{"path":"/tmp/foo","connections":0}}}`
+	assert.NoError(t, ioutil.WriteFile(persistence, []byte(v1), 0600))
+
+	d, err := driver.Init(t.TempDir())
+	assert.NoError(t, err)
+	defer d.Close()
+	resp, err := d.Get(&volume.GetRequest{Name: "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2020-11-11T00:00:00Z", resp.Volume.CreatedAt)
+
+	backup, err := ioutil.ReadFile(persistence + ".v1.bak")
+	assert.NoError(t, err)
+	assert.Equal(t, v1, string(backup))
+
+	var migrated struct {
+		Version int `json:"version"`
+		Volumes map[string]struct {
+			Args    string            `json:"args"`
+			Options map[string]string `json:"options"`
+		} `json:"volumes"`
+	}
+	b, err := ioutil.ReadFile(persistence)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(b, &migrated))
+	assert.Equal(t, driver.CfgVersion, migrated.Version)
+	assert.Equal(t, "", migrated.Volumes["foo"].Args)
+	assert.Equal(t, map[string]string{"uid": "33", "allow_other": "true"}, migrated.Volumes["foo"].Options)
 
-	if name != "test" {
-		t.Error("Expected to be test, got ", name)
+	//Refuse newer version without touching the file
+	newer := `{"version":999,"volumes":{},"mounts":{}}`
+	assert.NoError(t, ioutil.WriteFile(persistence, []byte(newer), 0600))
+	_, err = driver.Init(t.TempDir())
+	assert.IsType(t, &driver.VersionError{}, err)
+	b, err = ioutil.ReadFile(persistence)
+	assert.NoError(t, err)
+	assert.Equal(t, newer, string(b))
+
+	//Refuse to start with legacy args that can't be converted
+	unsupported := `{"version":1,"volumes":{"bar":{"args":"--uid 33 --unknown-flag","remote":"testing:/tmp","mount":"bar"}},"mounts":{"bar":{"path":"/tmp/bar"}}}`
+	assert.NoError(t, ioutil.WriteFile(persistence, []byte(unsupported), 0600))
+	_, err = driver.Init(t.TempDir())
+	assert.IsType(t, &driver.MigrationError{}, err)
+	assert.EqualError(t, err, "unable to migrate volume bar from persistence version 1: unsupported flag --unknown-flag in args")
+	b, err = ioutil.ReadFile(persistence)
+	assert.NoError(t, err)
+	assert.Equal(t, unsupported, string(b))
+}
+
+func TestReconcile(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	root := t.TempDir()
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	driver.MountInfoFile = mountInfo
+	defer func() { driver.MountInfoFile = "/proc/self/mountinfo" }()
+	assert.NoError(t, ioutil.WriteFile(mountInfo, []byte("22 1 0:21 / "+filepath.Join(root, "foreign")+" rw,relatime shared:5 - tmpfs tmpfs rw\n"), 0600))
+
+	assert.NoError(t, os.MkdirAll(driver.CfgFolder, 0700))
+	persistence := `{"version":2,"volumes":{` +
+		`"gone":{"remote":":local:/tmp","mount":"gone","connections":2},` +
+		`"foreign":{"remote":":local:/tmp","mount":"foreign","connections":1}},"mounts":{` +
+		`"gone":{"path":"` + filepath.Join(root, "gone") + `","connections":2,"pid":12345},` +
+		`"foreign":{"path":"` + filepath.Join(root, "foreign") + `","connections":1}}}`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(driver.CfgFolder, "persistence.json"), []byte(persistence), 0600))
+
+	d, err := driver.Init(root)
+	assert.NoError(t, err)
+	defer d.Close()
+
+	var state struct {
+		Mounts map[string]struct {
+			Connections int `json:"connections"`
+			PID         int `json:"pid"`
+		} `json:"mounts"`
 	}
+	b, err := ioutil.ReadFile(filepath.Join(driver.CfgFolder, "persistence.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(b, &state))
+	assert.Equal(t, 0, state.Mounts["gone"].Connections)
+	assert.Equal(t, 0, state.Mounts["gone"].PID)
+	assert.Equal(t, 1, state.Mounts["foreign"].Connections)
+}
+
+func TestGetStatus(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	d, err := driver.Init(t.TempDir())
+	assert.NoError(t, err)
+	defer d.Close()
+
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "s3", Options: map[string]string{
+		"remote":      ":s3,provider=AWS,access_key_id=AKIA,secret_access_key='x,y':bucket/path",
+		"read_only":   "true",
+		"uid":         "33",
+		"allow_other": "",
+	}}))
+	resp, err := d.Get(&volume.GetRequest{Name: "s3"})
+	assert.NoError(t, err)
+	status := resp.Volume.Status
+	assert.Equal(t, ":s3,provider=<redacted>,access_key_id=<redacted>,secret_access_key=<redacted>:bucket/path", status["remote"])
+	assert.Equal(t, "--allow-other --read-only --uid 33", status["flags"])
+	assert.Equal(t, filepath.Join(driver.CfgFolder, "rclone.conf"), status["config"])
+	assert.Equal(t, 0, status["connections"])
+	assert.Equal(t, "absent", status["health"])
+	assert.Equal(t, false, status["responding"])
+	assert.NotContains(t, status, "pid")
+}
+
+func TestGlobalScope(t *testing.T) {
+	_, err := driver.NewFileStore(filepath.Join(t.TempDir(), "missing"))
+	assert.True(t, os.IsNotExist(err), "a missing store folder is refused")
+	store, err := driver.NewFileStore(t.TempDir())
+	assert.NoError(t, err)
+	driver.CfgFolder = filepath.Join(t.TempDir(), "node1")
+	node1, err := driver.Init(t.TempDir(), driver.WithStore(store))
+	assert.NoError(t, err)
+	defer node1.Close()
+	driver.CfgFolder = filepath.Join(t.TempDir(), "node2")
+	root2 := t.TempDir()
+	node2, err := driver.Init(root2, driver.WithStore(store))
+	assert.NoError(t, err)
+	defer node2.Close()
+
+	assert.NoError(t, node1.Create(&volume.CreateRequest{Name: "shared", Options: map[string]string{"remote": ":local:/tmp", "read_only": "true"}}))
+	assert.NoError(t, node1.Create(&volume.CreateRequest{Name: "kept", Options: map[string]string{"remote": ":local:/tmp/kept"}}))
+
+	//Same name with another definition is refused by other nodes
+	assert.EqualError(t, node2.Create(&volume.CreateRequest{Name: "kept", Options: map[string]string{"remote": ":local:/tmp/other"}}), "volume kept already exists in shared store with a different definition")
+	assert.NoError(t, node2.Create(&volume.CreateRequest{Name: "kept", Options: map[string]string{"remote": ":local:/tmp/kept"}}))
+
+	//Visible from the other node with a local mountpoint
+	resp, err := node2.Get(&volume.GetRequest{Name: "shared"})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root2, resp.Volume.Status["mount"].(string)), resp.Volume.Mountpoint)
+	assert.Equal(t, "--read-only", resp.Volume.Status["flags"])
+	list, err := node2.List()
+	assert.NoError(t, err)
+	assert.Len(t, list.Volumes, 2)
+
+	//Removed from every node
+	assert.NoError(t, node1.Remove(&volume.RemoveRequest{Name: "shared"}))
+	list, err = node2.List()
+	assert.NoError(t, err)
+	assert.Len(t, list.Volumes, 1)
+	_, err = os.Stat(resp.Volume.Mountpoint)
+	assert.True(t, os.IsNotExist(err))
+
+	//An empty store doesn't drop local volumes
+	assert.NoError(t, store.Delete("kept"))
+	list, err = node2.List()
+	assert.NoError(t, err)
+	assert.Len(t, list.Volumes, 1)
+
+	//Invalid keys are refused
+	assert.Error(t, store.Put("../escape", []byte("{}")))
 }
 
 //Inspired from https://github.com/docker/go-plugins-helpers/blob/master/volume/api_test.go
@@ -57,9 +324,127 @@ const (
 	capabilitiesPath = "/VolumeDriver.Capabilities"
 )
 
+func TestCheckRclone(t *testing.T) {
+	defer func() {
+		driver.RcloneBinary = "rclone"
+		driver.CheckRclone() //Reset the binary used by other tests
+	}()
+	tests := []struct {
+		output  string
+		version string
+		err     string
+		rcErr   string
+	}{
+		{output: "rclone v1.53.3\n- os/arch: linux/amd64\n- go version: go1.15.5", version: "v1.53.3", rcErr: "rclone v1.53.3 is older than " + driver.MinRcRcloneVersion + ", minimum version of the rc backend"},
+		{output: "rclone v1.58.0-DEV\n", version: "v1.58.0-DEV", rcErr: "rclone v1.58.0-DEV is older than " + driver.MinRcRcloneVersion + ", minimum version of the rc backend"},
+		{output: "rclone v1.61.1\n", version: "v1.61.1"},
+		{output: "rclone v1.52\n", version: "v1.52", rcErr: "rclone v1.52 is older than " + driver.MinRcRcloneVersion + ", minimum version of the rc backend"},
+		{output: "rclone v1.49.1\n", err: "rclone v1.49.1 is older than minimum supported version " + driver.MinRcloneVersion},
+		{output: "command not found\n", err: `unable to parse rclone version from "command not found"`},
+	}
+	for _, test := range tests {
+		driver.RcloneBinary = filepath.Join(t.TempDir(), "rclone")
+		assert.NoError(t, ioutil.WriteFile(driver.RcloneBinary, []byte("#!/bin/sh\nprintf '"+test.output+"'\n"), 0700))
+		path, version, err := driver.CheckRclone()
+		if test.err != "" {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, driver.RcloneBinary, path)
+		assert.Equal(t, test.version, version)
+		if test.rcErr != "" {
+			assert.EqualError(t, driver.CheckRcBackend(), test.rcErr)
+		} else {
+			assert.NoError(t, driver.CheckRcBackend())
+		}
+	}
+
+	driver.RcloneBinary = filepath.Join(t.TempDir(), "missing")
+	_, _, err := driver.CheckRclone()
+	assert.Error(t, err)
+}
+
+func TestCommandErrors(t *testing.T) {
+	defer func() {
+		driver.RcloneBinary = "rclone"
+		driver.CommandTimeouts = map[string]int{}
+		driver.CheckRclone() //Reset the binary used by other tests
+	}()
+	dir := t.TempDir()
+	driver.RcloneBinary = filepath.Join(dir, "rclone")
+
+	assert.NoError(t, ioutil.WriteFile(driver.RcloneBinary, []byte("#!/bin/sh\necho 'bad flag' >&2\nexit 3\n"), 0700))
+	_, _, err := driver.CheckRclone()
+	var exitErr *driver.ExitError
+	if assert.True(t, errors.As(err, &exitErr)) {
+		assert.Equal(t, driver.OpVersion, exitErr.Op)
+		assert.Equal(t, 3, exitErr.Code)
+		assert.Equal(t, "bad flag", exitErr.Output)
+	}
+
+	assert.NoError(t, ioutil.WriteFile(driver.RcloneBinary, []byte("#!/bin/sh\nexec sleep 10\n"), 0700))
+	driver.CommandTimeouts = map[string]int{driver.OpVersion: 1}
+	start := time.Now()
+	_, _, err = driver.CheckRclone()
+	var timeoutErr *driver.TimeoutError
+	assert.True(t, errors.As(err, &timeoutErr))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+	assert.NoError(t, ioutil.WriteFile(driver.RcloneBinary, []byte("#!/bin/missing-interpreter\n"), 0700))
+	_, _, err = driver.CheckRclone()
+	var binErr *driver.BinaryNotFoundError
+	assert.True(t, errors.As(err, &binErr))
+
+	timeouts, err := driver.ParseCommandTimeouts("unmount=60, purge=600")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{driver.OpUnmount: 60, driver.OpPurge: 600}, timeouts)
+	_, err = driver.ParseCommandTimeouts("umount=60")
+	assert.EqualError(t, err, `unknown operation "umount" (mount, unmount, purge, version, rc)`)
+	_, err = driver.ParseCommandTimeouts("mount=-1")
+	assert.EqualError(t, err, `invalid timeout "-1" of operation mount`)
+}
+
+func TestMountOutput(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	driver.RcloneBinary = filepath.Join(t.TempDir(), "rclone")
+	driver.VolumeLogFolder = filepath.Join(t.TempDir(), "logs")
+	defer func() { driver.RcloneBinary, driver.VolumeLogFolder = "rclone", "" }()
+	assert.NoError(t, ioutil.WriteFile(driver.RcloneBinary, []byte(`#!/bin/sh
+echo '{"level":"error","msg":"Failed to create file system: bucket not found","source":"mount/mount.go:42"}' >&2
+echo 'plain output'
+exit 1
+`), 0700))
+	var logs bytes.Buffer
+	defer func(l zerolog.Logger) { log.Logger = l }(log.Logger)
+	log.Logger = zerolog.New(&logs)
+
+	d, err := driver.Init(t.TempDir())
+	assert.NoError(t, err)
+	defer d.Close()
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"remote": ":s3,secret_access_key=xxx:bucket"}}))
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	if assert.Error(t, err) {
+		var exitErr *driver.ExitError
+		assert.True(t, errors.As(err, &exitErr))
+		assert.Contains(t, err.Error(), "exited with status 1: error: Failed to create file system: bucket not found\ninfo: plain output")
+	}
+	assert.Contains(t, logs.String(), `{"level":"error","volume":"foo","remote":":s3,secret_access_key=<redacted>:bucket","source":"mount/mount.go:42","message":"Failed to create file system: bucket not found"}`)
+	assert.NotContains(t, logs.String(), "xxx")
+
+	foo, err := d.Get(&volume.GetRequest{Name: "foo"})
+	assert.NoError(t, err)
+	volumeLog, err := ioutil.ReadFile(filepath.Join(driver.VolumeLogFolder, foo.Volume.Status["mount"].(string)+".log"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"level":"error","msg":"Failed to create file system: bucket not found","source":"mount/mount.go:42"}`+"\nplain output\n", string(volumeLog))
+}
+
 func TestHandler(t *testing.T) {
 	//Setup
 	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
 	volumePath := filepath.Join(t.TempDir(), "volume")
 	dataPath := filepath.Join(t.TempDir(), "data")
 	assert.NoError(t, os.MkdirAll(dataPath, 0700))
@@ -68,8 +453,15 @@ func TestHandler(t *testing.T) {
 	rand.Read(testData)
 	ioutil.WriteFile(testFilePath, testData, 0666)
 
-	//Start in-memory handler
-	d := driver.Init(filepath.Join(volumePath, rclone.PluginAlias))
+	//Start in-memory handler (with a fake mounter under CI that has no rclone nor fuse)
+	var options []driver.Option
+	ci := os.Getenv("CI") == "true"
+	if ci {
+		options = append(options, driver.WithMounter(driver.NewFakeMounter()))
+	}
+	d, err := driver.Init(filepath.Join(volumePath, rclone.PluginAlias), options...)
+	assert.NoError(t, err)
+	defer d.Close()
 	h := volume.NewHandler(d)
 	l := sockets.NewInmemSocket("test", 0)
 	go h.Serve(l)
@@ -84,7 +476,7 @@ func TestHandler(t *testing.T) {
 	assert.NoError(t, err)
 	var vResp volume.ErrorResponse
 	assert.NoError(t, json.NewDecoder(resp).Decode(&vResp))
-	assert.Equal(t, "config and remote option required", vResp.Err)
+	assert.Equal(t, "remote option required", vResp.Err)
 
 	// Create No Remote
 	resp, err = pluginRequest(client, createPath, &volume.CreateRequest{Name: "foo", Options: map[string]string{
@@ -92,14 +484,14 @@ func TestHandler(t *testing.T) {
 	}})
 	assert.NoError(t, err)
 	assert.NoError(t, json.NewDecoder(resp).Decode(&vResp))
-	assert.Equal(t, "config and remote option required", vResp.Err)
-	// Create No Config
+	assert.Equal(t, "remote option required", vResp.Err)
+	// Create No Config and no shared config
 	resp, err = pluginRequest(client, createPath, &volume.CreateRequest{Name: "foo", Options: map[string]string{
-		"remote": "TODO",
+		"remote": "TODO:",
 	}})
 	assert.NoError(t, err)
 	assert.NoError(t, json.NewDecoder(resp).Decode(&vResp))
-	assert.Equal(t, "config and remote option required", vResp.Err)
+	assert.Contains(t, vResp.Err, "no config option and unable to read shared config")
 
 	// Create
 	resp, err = pluginRequest(client, createPath, &volume.CreateRequest{Name: "foo", Options: map[string]string{
@@ -108,8 +500,9 @@ func TestHandler(t *testing.T) {
 		"args":   "",
 	}})
 	assert.NoError(t, err)
-	assert.NoError(t, json.NewDecoder(resp).Decode(&vResp))
-	assert.Equal(t, "config and remote option required", vResp.Err)
+	var cvResp volume.ErrorResponse
+	assert.NoError(t, json.NewDecoder(resp).Decode(&cvResp))
+	assert.Equal(t, "", cvResp.Err)
 
 	//TODO test args
 
@@ -133,45 +526,39 @@ func TestHandler(t *testing.T) {
 	assert.NoError(t, err)
 	var pResp *volume.PathResponse
 	assert.NoError(t, json.NewDecoder(resp).Decode(&pResp))
-	assert.Equal(t, filepath.Join(volumePath, "rclone", "foo"), pResp.Mountpoint)
+	assert.Equal(t, filepath.Join(volumePath, "rclone", gResp.Volume.Status["mount"].(string)), pResp.Mountpoint)
 
-	if os.Getenv("CI") == "true" {
-		//Re-List
-		resp, err = pluginRequest(client, listPath, nil)
-		assert.NoError(t, err)
-		assert.NoError(t, json.NewDecoder(resp).Decode(&lResp))
-		assert.Equal(t, 1, len(lResp.Volumes))
-	} else {
-		// Mount
-		resp, err = pluginRequest(client, mountPath, &volume.MountRequest{Name: "foo"})
-		assert.NoError(t, err)
-		var mResp *volume.PathResponse
-		assert.NoError(t, json.NewDecoder(resp).Decode(&mResp))
-		assert.Equal(t, filepath.Join(volumePath, "rclone", "foo"), mResp.Mountpoint)
+	// Mount
+	resp, err = pluginRequest(client, mountPath, &volume.MountRequest{Name: "foo"})
+	assert.NoError(t, err)
+	var mResp *volume.PathResponse
+	assert.NoError(t, json.NewDecoder(resp).Decode(&mResp))
+	assert.Equal(t, pResp.Mountpoint, mResp.Mountpoint)
 
+	if !ci {
 		//Check content
 		filePathInVol := filepath.Join(mResp.Mountpoint, "test.file")
 		dataDetected, err := ioutil.ReadFile(filePathInVol)
 		assert.NoError(t, err)
 		assert.Equal(t, testData, dataDetected)
-		// Unmount
-		resp, err = pluginRequest(client, unmountPath, &volume.UnmountRequest{Name: "foo"})
-		assert.NoError(t, err)
-		var uResp volume.ErrorResponse
-		assert.NoError(t, json.NewDecoder(resp).Decode(&uResp))
-		assert.Equal(t, "", uResp.Err)
-		// Remove
-		resp, err = pluginRequest(client, removePath, &volume.RemoveRequest{Name: "foo"})
-		assert.NoError(t, err)
-		var rmResp volume.ErrorResponse
-		assert.NoError(t, json.NewDecoder(resp).Decode(&rmResp))
-		assert.Equal(t, "", rmResp.Err)
-		//Re-List
-		resp, err = pluginRequest(client, listPath, nil)
-		assert.NoError(t, err)
-		assert.NoError(t, json.NewDecoder(resp).Decode(&lResp))
-		assert.Equal(t, 0, len(lResp.Volumes))
 	}
+	// Unmount
+	resp, err = pluginRequest(client, unmountPath, &volume.UnmountRequest{Name: "foo"})
+	assert.NoError(t, err)
+	var uResp volume.ErrorResponse
+	assert.NoError(t, json.NewDecoder(resp).Decode(&uResp))
+	assert.Equal(t, "", uResp.Err)
+	// Remove
+	resp, err = pluginRequest(client, removePath, &volume.RemoveRequest{Name: "foo"})
+	assert.NoError(t, err)
+	var rmResp volume.ErrorResponse
+	assert.NoError(t, json.NewDecoder(resp).Decode(&rmResp))
+	assert.Equal(t, "", rmResp.Err)
+	//Re-List
+	resp, err = pluginRequest(client, listPath, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, json.NewDecoder(resp).Decode(&lResp))
+	assert.Equal(t, 0, len(lResp.Volumes))
 	// Capabilities
 	resp, err = pluginRequest(client, capabilitiesPath, nil)
 	assert.NoError(t, err)
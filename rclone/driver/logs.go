@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var (
+	//VolumeLogFolder folder of the rclone log file of each volume (empty to disable)
+	VolumeLogFolder = ""
+	//LogMaxSize max size of a log file in megabytes before rotation
+	LogMaxSize = 10
+	//LogMaxFiles max number of rotated files kept per log (0 to keep all)
+	LogMaxFiles = 5
+	//LogMaxAge max age of rotated files in days (0 to keep all)
+	LogMaxAge = 30
+	//logFiles rotating log files by path
+	logFiles     = make(map[string]*lumberjack.Logger)
+	logFilesLock sync.Mutex
+)
+
+//NewRotatingLog return a writer appending to path and rotating it according to LogMaxSize, LogMaxFiles and LogMaxAge
+func NewRotatingLog(path string) io.WriteCloser {
+	return &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    LogMaxSize,
+		MaxBackups: LogMaxFiles,
+		MaxAge:     LogMaxAge,
+		LocalTime:  true,
+	}
+}
+
+//OpenLog return the rotating log file at path
+//A single writer is kept by file to share it between successive processes and rotate it with RotateLogs.
+func OpenLog(path string) io.Writer {
+	logFilesLock.Lock()
+	defer logFilesLock.Unlock()
+	l, ok := logFiles[path]
+	if !ok {
+		l = NewRotatingLog(path).(*lumberjack.Logger)
+		logFiles[path] = l
+	}
+	return l
+}
+
+//logFile return the rotating log file name in VolumeLogFolder or nil if disabled
+func logFile(name string) io.Writer {
+	if VolumeLogFolder == "" {
+		return nil
+	}
+	return OpenLog(filepath.Join(VolumeLogFolder, name))
+}
+
+//mountLog return the rotating rclone log file of a mountpoint (<VolumeLogFolder>/<mount>.log) or nil if disabled
+//It is kept by mountpoint as the rclone process is shared by the volumes using it.
+func mountLog(mount string) io.Writer {
+	if !storeKeyRegexp.MatchString(mount) {
+		return nil
+	}
+	return logFile(mount + ".log")
+}
+
+//closeMountLog close the log file of a torn down mountpoint (rotated files are left to retention)
+func closeMountLog(mount string) {
+	path := filepath.Join(VolumeLogFolder, mount+".log")
+	logFilesLock.Lock()
+	defer logFilesLock.Unlock()
+	if l, ok := logFiles[path]; ok {
+		if err := l.Close(); err != nil {
+			log.Warn().Err(err).Msgf("Unable to close log of mountpoint %s", mount)
+		}
+		delete(logFiles, path)
+	}
+}
+
+//RotateLogs rotate all opened log files
+func RotateLogs() error {
+	logFilesLock.Lock()
+	defer logFilesLock.Unlock()
+	for path, l := range logFiles {
+		if err := l.Rotate(); err != nil {
+			return fmt.Errorf("unable to rotate %s: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "docker_volume_rclone"
+
+var (
+	mountDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_duration_seconds",
+		Help:      "Time to mount a volume by result (success or failure).",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"result"})
+	unmountDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "unmount_duration_seconds",
+		Help:      "Time to unmount a volume by result (success or failure).",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"result"})
+	mountFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_failures_total",
+		Help:      "Failed mounts by reason.",
+	}, []string{"reason"})
+
+	volumesDesc     = prometheus.NewDesc(metricsNamespace+"_volumes", "Volumes known by the driver.", nil, nil)
+	mountedDesc     = prometheus.NewDesc(metricsNamespace+"_mounts_mounted", "Mountpoints currently mounted.", nil, nil)
+	connectionsDesc = prometheus.NewDesc(metricsNamespace+"_volume_connections", "Containers using the volume.", []string{"volume"}, nil)
+	remountsDesc    = prometheus.NewDesc(metricsNamespace+"_volume_remounts_total", "Remounts of the volume by the watchdog.", []string{"volume"}, nil)
+	transferredDesc = prometheus.NewDesc(metricsNamespace+"_transferred_bytes_total", "Bytes transferred by the mountpoint of the volume.", []string{"volume"}, nil)
+	//vfsStatsDescs VFS stats of mounted volumes by path in the vfs/stats answer
+	vfsStatsDescs = map[string]*prometheus.Desc{
+		"diskCache.bytesUsed":         prometheus.NewDesc(metricsNamespace+"_vfs_cache_bytes", "Bytes used by the VFS cache of the volume.", []string{"volume"}, nil),
+		"diskCache.files":             prometheus.NewDesc(metricsNamespace+"_vfs_cache_files", "Files in the VFS cache of the volume.", []string{"volume"}, nil),
+		"diskCache.uploadsInProgress": prometheus.NewDesc(metricsNamespace+"_vfs_uploads_in_progress", "Uploads in progress from the VFS cache of the volume.", []string{"volume"}, nil),
+		"diskCache.uploadsQueued":     prometheus.NewDesc(metricsNamespace+"_vfs_uploads_queued", "Uploads queued in the VFS cache of the volume.", []string{"volume"}, nil),
+		"diskCache.erroredFiles":      prometheus.NewDesc(metricsNamespace+"_vfs_errored_files", "Files of the VFS cache of the volume that failed to upload.", []string{"volume"}, nil),
+		"metadataCache.files":         prometheus.NewDesc(metricsNamespace+"_vfs_metadata_files", "Files in the VFS metadata cache of the volume.", []string{"volume"}, nil),
+		"metadataCache.dirs":          prometheus.NewDesc(metricsNamespace+"_vfs_metadata_dirs", "Directories in the VFS metadata cache of the volume.", []string{"volume"}, nil),
+	}
+)
+
+//observeDuration record the duration of an operation started at start in h
+func observeDuration(h *prometheus.HistogramVec, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	h.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+//failureReason classify a mount error for metrics
+func failureReason(err error) string {
+	var rcErr *RcError
+	var timeoutErr *TimeoutError
+	var exitErr *ExitError
+	var binErr *BinaryNotFoundError
+	var optErr *optionsError
+	switch {
+	case errors.As(err, &timeoutErr):
+		return "timeout"
+	case errors.As(err, &exitErr):
+		return "exited"
+	case errors.As(err, &binErr):
+		return "binary"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.As(err, &rcErr):
+		return "rc"
+	case errors.As(err, &optErr):
+		return "options"
+	}
+	return "other"
+}
+
+//driverCollector export the state of the driver at each scrape
+type driverCollector struct {
+	d *RcloneDriver
+}
+
+//Describe implement prometheus.Collector
+func (c driverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumesDesc
+	ch <- mountedDesc
+	ch <- connectionsDesc
+	ch <- remountsDesc
+	ch <- transferredDesc
+	for _, desc := range vfsStatsDescs {
+		ch <- desc
+	}
+}
+
+//Collect implement prometheus.Collector
+//State is copied under the driver lock and mounts are checked after to not block the driver.
+func (c driverCollector) Collect(ch chan<- prometheus.Metric) {
+	d := c.d
+	paths := make(map[string]string)  //Volume -> mount path
+	mounts := make(map[string]string) //Volume -> mount name
+	d.RLock()
+	ch <- prometheus.MustNewConstMetric(volumesDesc, prometheus.GaugeValue, float64(len(d.volumes)))
+	for name, v := range d.volumes {
+		ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(v.Connections), name)
+		if m, ok := d.mounts[v.Mount]; ok {
+			ch <- prometheus.MustNewConstMetric(remountsDesc, prometheus.CounterValue, float64(m.Restarts), name)
+			paths[name] = m.Path
+			mounts[name] = v.Mount
+		}
+	}
+	d.RUnlock()
+
+	mounted := make(map[string]bool)
+	for _, path := range paths {
+		if ok, err := d.mounter.IsMounted(path); err == nil && ok {
+			mounted[path] = true
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(mountedDesc, prometheus.GaugeValue, float64(len(mounted)))
+
+	p, ok := d.mounter.(vfsStatsProvider)
+	if !ok {
+		return
+	}
+	for name, path := range paths {
+		if !mounted[path] {
+			continue
+		}
+		if bytes, err := p.transferredBytes(mounts[name]); err == nil {
+			ch <- prometheus.MustNewConstMetric(transferredDesc, prometheus.CounterValue, bytes, name)
+		}
+		stats, err := p.vfsStats(path)
+		if err != nil {
+			continue
+		}
+		for key, desc := range vfsStatsDescs {
+			if value, ok := statValue(stats, key); ok {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, name)
+			}
+		}
+	}
+}
+
+//statValue return the number at the dotted path of a decoded json document
+func statValue(doc map[string]interface{}, path string) (float64, bool) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		sub, ok := doc[key].(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		doc = sub
+	}
+	value, ok := doc[keys[len(keys)-1]].(float64)
+	return value, ok
+}
+
+//MetricsHandler return a http handler exposing the prometheus metrics of the driver
+func (d *RcloneDriver) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		driverCollector{d: d},
+		mountDuration,
+		unmountDuration,
+		mountFailures,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
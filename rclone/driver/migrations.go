@@ -0,0 +1,189 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+//persistenceMigration upgrade a decoded persistence document from one version to the next
+type persistenceMigration func(doc map[string]interface{}) error
+
+//persistenceMigrations migrations indexed by the version they upgrade from
+var persistenceMigrations = map[int]persistenceMigration{
+	1: migrateArgsToOptions,
+	2: migrateConnectionsToIDs,
+}
+
+//VersionError is returned when the persistence file has been written by a newer version of the driver
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("persistence version %d is newer than supported version %d", e.Version, CfgVersion)
+}
+
+//MigrationError is returned when a volume of the persistence file can't be migrated without breaking it
+type MigrationError struct {
+	Version int
+	Volume  string
+	Err     error
+}
+
+func (e *MigrationError) Error() string {
+	return fmt.Sprintf("unable to migrate volume %s from persistence version %d: %v", e.Volume, e.Version, e.Err)
+}
+
+//unrecoverable check if the persistence error must stop the driver instead of starting with an empty state
+func unrecoverable(err error) bool {
+	switch err.(type) {
+	case *VersionError, *MigrationError:
+		return true
+	}
+	return false
+}
+
+//decodePersistence decode a persistence document and upgrade it to CfgVersion
+//It return the version the document was written with.
+func decodePersistence(b []byte) (*RclonePersistence, int, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, 0, err
+	}
+	version := 1 //Files written before versioning are considered as the first version
+	if raw, ok := doc["version"]; ok {
+		v, ok := raw.(float64)
+		if !ok || v != float64(int(v)) {
+			return nil, 0, fmt.Errorf("invalid version %v", raw)
+		}
+		version = int(v)
+	}
+	if version > CfgVersion {
+		return nil, version, &VersionError{Version: version}
+	}
+	for v := version; v < CfgVersion; v++ {
+		migrate, ok := persistenceMigrations[v]
+		if !ok {
+			return nil, version, fmt.Errorf("no migration from persistence version %d", v)
+		}
+		log.Info().Msgf("Migrating persistence from version %d to %d", v, v+1)
+		if err := migrate(doc); err != nil {
+			if mErr, ok := err.(*MigrationError); ok {
+				mErr.Version = v
+				return nil, version, mErr
+			}
+			return nil, version, fmt.Errorf("migration from version %d failed: %v", v, err)
+		}
+		doc["version"] = v + 1
+	}
+	//Re-encode the migrated document to decode it in typed struct
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, version, err
+	}
+	var p RclonePersistence
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, version, err
+	}
+	return &p, version, nil
+}
+
+//docVolumes return the volumes of a persistence document
+func docVolumes(doc map[string]interface{}) (map[string]map[string]interface{}, error) {
+	volumes := make(map[string]map[string]interface{})
+	raw, ok := doc["volumes"]
+	if !ok || raw == nil {
+		return volumes, nil
+	}
+	list, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid volumes format")
+	}
+	for name, v := range list {
+		vol, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid format of volume %s", name)
+		}
+		volumes[name] = vol
+	}
+	return volumes, nil
+}
+
+//docMounts return the mounts of a persistence document
+func docMounts(doc map[string]interface{}) (map[string]map[string]interface{}, error) {
+	mounts := make(map[string]map[string]interface{})
+	raw, ok := doc["mounts"]
+	if !ok || raw == nil {
+		return mounts, nil
+	}
+	list, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid mounts format")
+	}
+	for name, m := range list {
+		mount, ok := m.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid format of mount %s", name)
+		}
+		mounts[name] = mount
+	}
+	return mounts, nil
+}
+
+//migrateArgsToOptions v1 -> v2: convert free-form args to typed options
+func migrateArgsToOptions(doc map[string]interface{}) error {
+	volumes, err := docVolumes(doc)
+	if err != nil {
+		return err
+	}
+	for name, vol := range volumes {
+		args, _ := vol["args"].(string)
+		if args == "" {
+			delete(vol, "args")
+			continue
+		}
+		opts, err := parseArgs(args)
+		if err != nil { //Refused at each mount otherwise
+			return &MigrationError{Volume: name, Err: err}
+		}
+		existing, _ := vol["options"].(map[string]interface{})
+		for key, value := range existing {
+			opts[key] = fmt.Sprint(value)
+		}
+		vol["options"] = opts
+		delete(vol, "args")
+	}
+	return nil
+}
+
+//migrateConnectionsToIDs v2 -> v3: convert connection counters of volumes to legacy mount IDs
+func migrateConnectionsToIDs(doc map[string]interface{}) error {
+	volumes, err := docVolumes(doc)
+	if err != nil {
+		return err
+	}
+	mounts, err := docMounts(doc)
+	if err != nil {
+		return err
+	}
+	for name, vol := range volumes {
+		connections, _ := vol["connections"].(float64)
+		mountName, _ := vol["mount"].(string)
+		mount, ok := mounts[mountName]
+		if !ok || connections <= 0 {
+			continue
+		}
+		ids, ok := mount["ids"].(map[string]interface{})
+		if !ok {
+			ids = make(map[string]interface{})
+			mount["ids"] = ids
+		}
+		for i := 0; i < int(connections); i++ {
+			ids[fmt.Sprintf("%s%s-%d", legacyRefPrefix, name, i)] = name
+		}
+		mount["connections"] = len(ids)
+	}
+	return nil
+}
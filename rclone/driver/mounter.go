@@ -0,0 +1,171 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//MountSpec describe a remote to mount on the host
+type MountSpec struct {
+	Name    string            //Name of the mountpoint, used to isolate its runtime files
+	Volume  string            //Volume requesting the mount, used in logs
+	Path    string            //Path to mount on
+	Remote  string            //Rclone remote to mount
+	Config  string            //Base64 rclone config of the volume (empty to use the shared config)
+	Options map[string]string //Validated rclone mount options
+}
+
+//Mounter mount rclone remotes on the host
+type Mounter interface {
+	//Mount mount the remote on spec.Path and return once it is ready, giving up when ctx is done
+	Mount(ctx context.Context, spec MountSpec) error
+	//Unmount unmount spec.Path and release its resources (no error if not mounted), giving up when ctx is done
+	Unmount(ctx context.Context, spec MountSpec) error
+	//IsMounted check if path is a rclone mount
+	IsMounted(path string) (bool, error)
+	//List return the paths mounted by rclone
+	List() ([]string, error)
+}
+
+//processTracker is implemented by mounters running a rclone process per mount
+type processTracker interface {
+	process(path string) *rcloneProcess
+}
+
+//WithMounter use m to mount volumes in place of a rclone mount process per volume
+func WithMounter(m Mounter) Option {
+	return func(d *RcloneDriver) {
+		d.mounter = m
+	}
+}
+
+//mountSpec return what to mount for the volume on the mountpoint
+func mountSpec(name string, v *rcloneVolume, m *rcloneMountpoint, opts map[string]string) MountSpec {
+	return MountSpec{Name: v.Mount, Volume: name, Path: m.Path, Remote: v.Remote, Config: v.Config, Options: opts}
+}
+
+//process return the rclone process serving the mountpoint if tracked by the mounter
+func (d *RcloneDriver) process(m *rcloneMountpoint) *rcloneProcess {
+	if t, ok := d.mounter.(processTracker); ok {
+		return t.process(m.Path)
+	}
+	return nil
+}
+
+//unmountPath lazy unmount path and force it if it fails
+func unmountPath(ctx context.Context, path string) error {
+	if _, err := runCommand(ctx, OpUnmount, "umount", "-l", path); err != nil {
+		log.Warn().Err(err).Msgf("Lazy unmount of %s failed, forcing it", path)
+		select { //Wait a little and force unmount
+		case <-ctx.Done():
+			return fmt.Errorf("unmount of %s cancelled: %w", path, ctx.Err())
+		case <-time.After(15 * time.Second):
+		}
+		if _, err := runCommand(ctx, OpUnmount, "umount", "-f", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//FakeMounter in-memory Mounter for tests, nothing is mounted on the host
+type FakeMounter struct {
+	sync.Mutex
+	mounts map[string]MountSpec
+	calls  []string
+	//MountErr if set is returned by Mount
+	MountErr error
+	//UnmountErr if set is returned by Unmount of mounted paths
+	UnmountErr error
+	//Delay if set is waited by Mount to simulate a slow rclone start
+	Delay time.Duration
+}
+
+//NewFakeMounter return an empty FakeMounter
+func NewFakeMounter() *FakeMounter {
+	return &FakeMounter{mounts: make(map[string]MountSpec)}
+}
+
+//Mount implement Mounter
+func (f *FakeMounter) Mount(ctx context.Context, spec MountSpec) error {
+	f.Lock()
+	f.calls = append(f.calls, "mount "+spec.Volume)
+	delay, err := f.Delay, f.MountErr
+	f.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+	}
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.mounts[spec.Path] = spec
+	return nil
+}
+
+//Unmount implement Mounter
+func (f *FakeMounter) Unmount(ctx context.Context, spec MountSpec) error {
+	f.Lock()
+	defer f.Unlock()
+	mounted, ok := f.mounts[spec.Path]
+	if !ok {
+		return nil
+	}
+	f.calls = append(f.calls, "unmount "+mounted.Volume)
+	if f.UnmountErr != nil {
+		return f.UnmountErr
+	}
+	delete(f.mounts, spec.Path)
+	return nil
+}
+
+//IsMounted implement Mounter
+func (f *FakeMounter) IsMounted(path string) (bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	_, ok := f.mounts[path]
+	return ok, nil
+}
+
+//List implement Mounter
+func (f *FakeMounter) List() ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+	paths := make([]string, 0, len(f.mounts))
+	for path := range f.mounts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+//Mounted return the spec mounted on path
+func (f *FakeMounter) Mounted(path string) (MountSpec, bool) {
+	f.Lock()
+	defer f.Unlock()
+	spec, ok := f.mounts[path]
+	return spec, ok
+}
+
+//Kill simulate a mount dying without being unmounted by the driver
+func (f *FakeMounter) Kill(path string) {
+	f.Lock()
+	defer f.Unlock()
+	log.Debug().Msgf("Fake mount %s killed", path)
+	delete(f.mounts, path)
+}
+
+//Calls return the mount and unmount calls done on mounted paths with the volume which mounted it (ex: "mount foo")
+func (f *FakeMounter) Calls() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.calls...)
+}
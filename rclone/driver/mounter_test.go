@@ -0,0 +1,545 @@
+package driver_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+
+	"github.com/sapk/docker-volume-rclone/rclone/driver"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//step an operation on the driver (create, mount, unmount, remove, kill, failmount, failunmount)
+type step struct {
+	op     string
+	volume string
+	remote string //Remote of created volume (default to a folder by volume)
+	id     string
+	err    string
+}
+
+func TestDriverLifecycle(t *testing.T) {
+	tests := []struct {
+		name        string
+		steps       []step
+		calls       []string
+		mounted     []string //Volumes mounted at the end
+		connections map[string]int
+	}{
+		{
+			name:  "create without remote",
+			steps: []step{{op: "create", volume: "foo", err: "remote option required"}},
+		},
+		{
+			name:  "mount unknown volume",
+			steps: []step{{op: "mount", volume: "foo", id: "c1", err: "volume foo not found"}},
+		},
+		{
+			name:  "remove unknown volume",
+			steps: []step{{op: "remove", volume: "foo", err: "volume foo not found"}},
+		},
+		{
+			name:        "mount and unmount",
+			steps:       []step{{op: "create", volume: "foo"}, {op: "mount", volume: "foo", id: "c1"}, {op: "unmount", volume: "foo", id: "c1"}},
+			calls:       []string{"mount foo", "unmount foo"},
+			connections: map[string]int{"foo": 0},
+		},
+		{
+			name:        "retried mount with same id",
+			steps:       []step{{op: "create", volume: "foo"}, {op: "mount", volume: "foo", id: "c1"}, {op: "mount", volume: "foo", id: "c1"}},
+			calls:       []string{"mount foo"},
+			mounted:     []string{"foo"},
+			connections: map[string]int{"foo": 1},
+		},
+		{
+			name: "mount shared by two containers",
+			steps: []step{{op: "create", volume: "foo"}, {op: "mount", volume: "foo", id: "c1"}, {op: "mount", volume: "foo", id: "c2"},
+				{op: "unmount", volume: "foo", id: "c1"}},
+			calls:       []string{"mount foo"},
+			mounted:     []string{"foo"},
+			connections: map[string]int{"foo": 1},
+		},
+		{
+			name: "retried unmount",
+			steps: []step{{op: "create", volume: "foo"}, {op: "mount", volume: "foo", id: "c1"}, {op: "mount", volume: "foo", id: "c2"},
+				{op: "unmount", volume: "foo", id: "c1"}, {op: "unmount", volume: "foo", id: "c1"}},
+			calls:       []string{"mount foo"},
+			mounted:     []string{"foo"},
+			connections: map[string]int{"foo": 1},
+		},
+		{
+			name:        "mounts without id",
+			steps:       []step{{op: "create", volume: "foo"}, {op: "mount", volume: "foo"}, {op: "mount", volume: "foo"}, {op: "unmount", volume: "foo"}},
+			calls:       []string{"mount foo"},
+			mounted:     []string{"foo"},
+			connections: map[string]int{"foo": 1},
+		},
+		{
+			name:        "failed mount",
+			steps:       []step{{op: "create", volume: "foo"}, {op: "failmount", volume: "foo", id: "c1", err: "mount failed"}},
+			calls:       []string{"mount foo"},
+			connections: map[string]int{"foo": 0},
+		},
+		{
+			name:        "failed unmount keep the reference",
+			steps:       []step{{op: "create", volume: "foo"}, {op: "mount", volume: "foo", id: "c1"}, {op: "failunmount", volume: "foo", id: "c1", err: "unmount failed"}},
+			calls:       []string{"mount foo", "unmount foo"},
+			mounted:     []string{"foo"},
+			connections: map[string]int{"foo": 1},
+		},
+		{
+			name:        "dead mount is remounted",
+			steps:       []step{{op: "create", volume: "foo"}, {op: "mount", volume: "foo", id: "c1"}, {op: "kill", volume: "foo"}, {op: "mount", volume: "foo", id: "c2"}},
+			calls:       []string{"mount foo", "mount foo"},
+			mounted:     []string{"foo"},
+			connections: map[string]int{"foo": 2},
+		},
+		{
+			name:        "remove mounted volume",
+			steps:       []step{{op: "create", volume: "foo"}, {op: "mount", volume: "foo", id: "c1"}, {op: "remove", volume: "foo", err: "volume foo is in use by 1 containers"}},
+			calls:       []string{"mount foo"},
+			mounted:     []string{"foo"},
+			connections: map[string]int{"foo": 1},
+		},
+		{
+			name: "remove unmounted volume",
+			steps: []step{{op: "create", volume: "foo"}, {op: "mount", volume: "foo", id: "c1"}, {op: "unmount", volume: "foo", id: "c1"},
+				{op: "remove", volume: "foo"}},
+			calls: []string{"mount foo", "unmount foo"},
+		},
+		{
+			name: "volumes are independent",
+			steps: []step{{op: "create", volume: "foo"}, {op: "create", volume: "bar"}, {op: "mount", volume: "foo", id: "c1"},
+				{op: "mount", volume: "bar", id: "c1"}, {op: "unmount", volume: "bar", id: "c1"}},
+			calls:       []string{"mount foo", "mount bar", "unmount bar"},
+			mounted:     []string{"foo"},
+			connections: map[string]int{"foo": 1, "bar": 0},
+		},
+		{
+			name: "recreate with other definition",
+			steps: []step{{op: "create", volume: "foo"}, {op: "create", volume: "foo"},
+				{op: "create", volume: "foo", remote: ":local:/tmp/other", err: "volume foo already exists with a different definition"}},
+		},
+		{
+			name: "identical volumes share the mount",
+			steps: []step{{op: "create", volume: "foo", remote: ":local:/tmp/data"}, {op: "create", volume: "bar", remote: ":local:/tmp/data"},
+				{op: "mount", volume: "foo", id: "c1"}, {op: "mount", volume: "bar", id: "c2"}, {op: "unmount", volume: "foo", id: "c1"}},
+			calls:       []string{"mount foo"},
+			mounted:     []string{"foo", "bar"},
+			connections: map[string]int{"foo": 0, "bar": 1},
+		},
+		{
+			name: "remove volume sharing the mount",
+			steps: []step{{op: "create", volume: "foo", remote: ":local:/tmp/data"}, {op: "create", volume: "bar", remote: ":local:/tmp/data"},
+				{op: "mount", volume: "foo", id: "c1"}, {op: "remove", volume: "bar"}},
+			calls:       []string{"mount foo"},
+			mounted:     []string{"foo"},
+			connections: map[string]int{"foo": 1},
+		},
+		{
+			name: "remove last volume of the mount",
+			steps: []step{{op: "create", volume: "foo", remote: ":local:/tmp/data"}, {op: "create", volume: "bar", remote: ":local:/tmp/data"},
+				{op: "mount", volume: "foo", id: "c1"}, {op: "mount", volume: "bar", id: "c2"}, {op: "unmount", volume: "foo", id: "c1"},
+				{op: "remove", volume: "foo"}, {op: "unmount", volume: "bar", id: "c2"}, {op: "remove", volume: "bar"}},
+			calls: []string{"mount foo", "unmount foo"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+			driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+			fake := driver.NewFakeMounter()
+			d, err := driver.Init(t.TempDir(), driver.WithMounter(fake))
+			assert.NoError(t, err)
+			defer d.Close()
+
+			paths := make(map[string]string)
+			for _, s := range test.steps {
+				fake.MountErr, fake.UnmountErr = nil, nil
+				switch s.op {
+				case "create":
+					opts := map[string]string{"remote": ":local:/tmp/" + s.volume}
+					if s.remote != "" {
+						opts["remote"] = s.remote
+					} else if s.err != "" {
+						opts = nil
+					}
+					err = d.Create(&volume.CreateRequest{Name: s.volume, Options: opts})
+				case "failmount":
+					fake.MountErr = errors.New("mount failed")
+					fallthrough
+				case "mount":
+					var resp *volume.MountResponse
+					resp, err = d.Mount(&volume.MountRequest{Name: s.volume, ID: s.id})
+					if err == nil {
+						paths[s.volume] = resp.Mountpoint
+					}
+				case "failunmount":
+					fake.UnmountErr = errors.New("unmount failed")
+					fallthrough
+				case "unmount":
+					err = d.Unmount(&volume.UnmountRequest{Name: s.volume, ID: s.id})
+				case "remove":
+					err = d.Remove(&volume.RemoveRequest{Name: s.volume})
+				case "kill":
+					fake.Kill(paths[s.volume])
+					err = nil
+				}
+				if s.err != "" {
+					assert.EqualError(t, err, s.err, "%s %s", s.op, s.volume)
+				} else {
+					assert.NoError(t, err, "%s %s", s.op, s.volume)
+				}
+			}
+
+			assert.Equal(t, test.calls, fake.Calls())
+			var mounted []string
+			for name, path := range paths {
+				if _, ok := fake.Mounted(path); ok {
+					mounted = append(mounted, name)
+				}
+			}
+			assert.ElementsMatch(t, test.mounted, mounted)
+			for name, connections := range test.connections {
+				resp, err := d.Get(&volume.GetRequest{Name: name})
+				if assert.NoError(t, err) {
+					assert.Equal(t, connections, resp.Volume.Status["connections"], name)
+				}
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	fake := driver.NewFakeMounter()
+	d, err := driver.Init(t.TempDir(), driver.WithMounter(fake))
+	assert.NoError(t, err)
+	defer d.Close()
+
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"remote": ":local:/tmp/foo"}}))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "bar", Options: map[string]string{"remote": ":local:/tmp/bar"}}))
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NoError(t, err)
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c2"})
+	assert.NoError(t, err)
+	fake.MountErr = &driver.TimeoutError{Op: driver.OpMount, Command: "rclone mount /foo", Timeout: 30 * time.Second}
+	_, err = d.Mount(&volume.MountRequest{Name: "bar", ID: "c3"})
+	assert.Error(t, err)
+
+	rec := httptest.NewRecorder()
+	d.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := rec.Body.String()
+	assert.Contains(t, metrics, "docker_volume_rclone_volumes 2\n")
+	assert.Contains(t, metrics, "docker_volume_rclone_mounts_mounted 1\n")
+	assert.Contains(t, metrics, `docker_volume_rclone_volume_connections{volume="foo"} 2`)
+	assert.Contains(t, metrics, `docker_volume_rclone_volume_connections{volume="bar"} 0`)
+	assert.Contains(t, metrics, `docker_volume_rclone_mount_failures_total{reason="timeout"}`)
+	assert.Contains(t, metrics, `docker_volume_rclone_mount_duration_seconds_count{result="success"}`)
+}
+
+func TestAdmin(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	root := t.TempDir()
+	fake := driver.NewFakeMounter()
+	d, err := driver.Init(root, driver.WithMounter(fake))
+	assert.NoError(t, err)
+	defer d.Close()
+
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"remote": ":local:/tmp/foo"}}))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "bar", Options: map[string]string{"remote": ":local:/tmp/bar"}}))
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NoError(t, err)
+	resp, err := d.Mount(&volume.MountRequest{Name: "bar", ID: "c2"})
+	assert.NoError(t, err)
+
+	//Offline view of the persisted state
+	a, err := driver.Open(root, driver.WithMounter(fake))
+	assert.NoError(t, err)
+	vols, err := a.Volumes()
+	assert.NoError(t, err)
+	if assert.Len(t, vols, 2) {
+		assert.Equal(t, "bar", vols[0].Name)
+		assert.Equal(t, "foo", vols[1].Name)
+	}
+	vol, err := a.Inspect("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, vol.Status["connections"])
+
+	assert.EqualError(t, a.RemoveVolume("foo", false), "volume foo is in use by 1 containers")
+	fake.Kill(resp.Mountpoint)
+	actions, err := a.Prune()
+	assert.NoError(t, err)
+	if assert.Len(t, actions, 1) {
+		assert.Contains(t, actions[0], "forgot 1 references")
+	}
+	actions, err = a.Prune()
+	assert.NoError(t, err)
+	assert.Empty(t, actions)
+	assert.NoError(t, a.RemoveVolume("foo", true))
+	assert.EqualError(t, a.UnmountVolume("foo"), "volume foo not found")
+	assert.Equal(t, []string{"mount foo", "mount bar", "unmount foo"}, fake.Calls())
+
+	a, err = driver.Open(root, driver.WithMounter(fake))
+	assert.NoError(t, err)
+	vols, err = a.Volumes()
+	assert.NoError(t, err)
+	if assert.Len(t, vols, 1) {
+		assert.Equal(t, "bar", vols[0].Name)
+		assert.Equal(t, 0, vols[0].Status["connections"])
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	fake := driver.NewFakeMounter()
+	d, err := driver.Init(t.TempDir(), driver.WithMounter(fake))
+	assert.NoError(t, err)
+	defer d.Close()
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"remote": ":local:/tmp/foo"}}))
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NoError(t, err)
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	go d.ServeAdmin(socket)
+	c := driver.NewAdminClient(socket)
+	var vols []*volume.Volume
+	assert.Eventually(t, func() bool {
+		vols, err = c.Volumes()
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	if assert.Len(t, vols, 1) {
+		assert.Equal(t, "foo", vols[0].Name)
+		assert.Equal(t, float64(1), vols[0].Status["connections"])
+	}
+	_, err = c.Inspect("bar")
+	assert.EqualError(t, err, "volume bar not found")
+	assert.EqualError(t, c.RemoveVolume("foo", false), "volume foo is in use by 1 containers")
+
+	assert.NoError(t, c.RemountVolume("foo"))
+	_, err = c.ReloadConfig()
+	assert.Error(t, err, "shared config missing")
+	assert.NoError(t, os.MkdirAll(driver.CfgFolder, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(driver.CfgFolder, "rclone.conf"), nil, 0600))
+	remounted, err := c.ReloadConfig()
+	assert.NoError(t, err)
+	assert.Len(t, remounted, 1)
+	assert.NoError(t, c.UnmountVolume("foo"))
+	assert.Equal(t, []string{"mount foo", "unmount foo", "mount foo", "unmount foo", "mount foo", "unmount foo"}, fake.Calls())
+
+	actions, err := c.Prune()
+	assert.NoError(t, err)
+	assert.Empty(t, actions)
+	assert.NoError(t, c.RotateLogs())
+	var dump bytes.Buffer
+	assert.NoError(t, c.Goroutines(&dump))
+	assert.Contains(t, dump.String(), "goroutine ")
+}
+
+func TestSubpath(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	fake := driver.NewFakeMounter()
+	d, err := driver.Init(t.TempDir(), driver.WithMounter(fake))
+	assert.NoError(t, err)
+	defer d.Close()
+
+	assert.EqualError(t, d.Create(&volume.CreateRequest{Name: "bad", Options: map[string]string{"remote": ":local:/tmp/bucket", "create_subpath": "true"}}),
+		"create_subpath option requires subpath option")
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "a", Options: map[string]string{"remote": ":local:/tmp/bucket", "subpath": "team-a", "create_subpath": ""}}))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "b", Options: map[string]string{"remote": ":local:/tmp/bucket", "subpath": "../../team-b/"}}))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "a", Options: map[string]string{"remote": ":local:/tmp/bucket", "subpath": "team-a", "create_subpath": "true"}}))
+	assert.EqualError(t, d.Create(&volume.CreateRequest{Name: "a", Options: map[string]string{"remote": ":local:/tmp/bucket", "subpath": "team-a"}}),
+		"volume a already exists with a different definition")
+
+	a, err := d.Get(&volume.GetRequest{Name: "a"})
+	assert.NoError(t, err)
+	b, err := d.Get(&volume.GetRequest{Name: "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, a.Volume.Status["mount"], b.Volume.Status["mount"])
+	assert.Equal(t, "team-b", b.Volume.Status["subpath"])
+	path := a.Volume.Status["path"].(string)
+	assert.Equal(t, filepath.Join(path, "team-b"), b.Volume.Mountpoint)
+
+	resp, err := d.Mount(&volume.MountRequest{Name: "a", ID: "c1"})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(path, "team-a"), resp.Mountpoint)
+	assert.DirExists(t, resp.Mountpoint)
+	_, err = d.Mount(&volume.MountRequest{Name: "b", ID: "c2"})
+	assert.EqualError(t, err, "subpath team-b not found on remote (set create_subpath to create it)")
+	_, mounted := fake.Mounted(path)
+	assert.True(t, mounted, "mount of a kept")
+
+	assert.NoError(t, d.Unmount(&volume.UnmountRequest{Name: "a", ID: "c1"}))
+	_, err = d.Mount(&volume.MountRequest{Name: "b", ID: "c2"})
+	assert.Error(t, err)
+	_, mounted = fake.Mounted(path)
+	assert.False(t, mounted, "failed mount of b cleaned")
+	assert.Equal(t, []string{"mount a", "unmount a", "mount b", "unmount b"}, fake.Calls())
+}
+
+func TestPurgeOnRemove(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	defer func() {
+		driver.RcloneBinary = "rclone"
+		driver.CheckRclone() //Reset the binary used by other tests
+	}()
+	calls := filepath.Join(t.TempDir(), "calls")
+	driver.RcloneBinary = filepath.Join(t.TempDir(), "rclone")
+	assert.NoError(t, ioutil.WriteFile(driver.RcloneBinary, []byte("#!/bin/sh\n[ \"$1\" = version ] && echo 'rclone v1.53.3' && exit 0\ncase \"$2\" in *fail*) echo 'permission denied' >&2; exit 1;; esac\necho \"$@\" >> "+calls+"\n"), 0700))
+	_, _, err := driver.CheckRclone()
+	assert.NoError(t, err)
+	d, err := driver.Init(t.TempDir(), driver.WithMounter(driver.NewFakeMounter()))
+	assert.NoError(t, err)
+	defer d.Close()
+
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "root", Options: map[string]string{"remote": ":memory:", "purge_on_remove": "true"}}))
+	assert.EqualError(t, d.Remove(&volume.RemoveRequest{Name: "root"}), "refusing to purge the root of remote :memory:")
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "a", Options: map[string]string{"remote": ":local:/tmp/bucket", "subpath": "a", "purge_on_remove": ""}}))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "all", Options: map[string]string{"remote": ":local:/tmp/bucket/", "purge_on_remove": "true"}}))
+	assert.EqualError(t, d.Remove(&volume.RemoveRequest{Name: "all"}), "refusing to purge :local:/tmp/bucket used by volume a")
+	assert.EqualError(t, d.Remove(&volume.RemoveRequest{Name: "a"}), "refusing to purge :local:/tmp/bucket/a used by volume all")
+
+	//Volume of another mountpoint (other flags) exposing a parent folder
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "x", Options: map[string]string{"remote": ":local:/tmp/other/x", "purge_on_remove": "true"}}))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "ro", Options: map[string]string{"remote": ":local:/tmp/other", "read_only": "true"}}))
+	assert.EqualError(t, d.Remove(&volume.RemoveRequest{Name: "x"}), "refusing to purge :local:/tmp/other/x used by volume ro")
+	assert.NoError(t, d.Remove(&volume.RemoveRequest{Name: "ro"}))
+	assert.NoError(t, d.Remove(&volume.RemoveRequest{Name: "x"}))
+	b, err := ioutil.ReadFile(calls)
+	assert.NoError(t, err)
+	config := filepath.Join(driver.CfgFolder, "rclone.conf")
+	assert.Equal(t, "purge :local:/tmp/other/x --config "+config+"\n", string(b))
+	list, err := d.List()
+	assert.NoError(t, err)
+	assert.Len(t, list.Volumes, 3)
+
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "fail", Options: map[string]string{"remote": ":local:/tmp/fail", "purge_on_remove": "true"}}))
+	err = d.Remove(&volume.RemoveRequest{Name: "fail"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "exited with status 1: permission denied")
+	}
+	resp, err := d.Mount(&volume.MountRequest{Name: "fail", ID: "c1"})
+	assert.NoError(t, err, "volume kept mountable after failed purge")
+	assert.DirExists(t, resp.Mountpoint)
+
+	assert.NoError(t, os.Remove(calls))
+	conf := base64.StdEncoding.EncodeToString([]byte("[s3]\ntype = s3\n"))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "private", Options: map[string]string{"remote": "s3:bucket/data", "config": conf, "purge_on_remove": "true"}}))
+	private, err := d.Get(&volume.GetRequest{Name: "private"})
+	assert.NoError(t, err)
+	assert.NoError(t, d.Remove(&volume.RemoveRequest{Name: "private"}))
+	b, err = ioutil.ReadFile(calls)
+	assert.NoError(t, err)
+	dir := filepath.Join(driver.RuntimeFolder, "_purge-"+private.Volume.Status["mount"].(string))
+	assert.Equal(t, "purge s3:bucket/data --config "+filepath.Join(dir, "rclone.conf")+"\n", string(b))
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err), "purge config removed")
+}
+
+func TestConcurrentMount(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	fake := driver.NewFakeMounter()
+	fake.Delay = 500 * time.Millisecond
+	d, err := driver.Init(t.TempDir(), driver.WithMounter(fake))
+	assert.NoError(t, err)
+	defer d.Close()
+
+	for _, name := range []string{"foo", "bar", "fail"} {
+		assert.NoError(t, d.Create(&volume.CreateRequest{Name: name, Options: map[string]string{"remote": ":local:/tmp/" + name}}))
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = d.Mount(&volume.MountRequest{Name: "foo", ID: fmt.Sprintf("c%d", i)})
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := d.Mount(&volume.MountRequest{Name: "bar", ID: "b1"})
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	readStart := time.Now()
+	_, err = d.List()
+	assert.NoError(t, err)
+	_, err = d.Get(&volume.GetRequest{Name: "bar"})
+	assert.NoError(t, err)
+	_, err = d.Path(&volume.PathRequest{Name: "foo"})
+	assert.NoError(t, err)
+	assert.Less(t, int64(time.Since(readStart)), int64(fake.Delay/2), "read calls not blocked by mounts")
+
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(2*fake.Delay), "volumes mounted in parallel")
+	calls := fake.Calls()
+	assert.ElementsMatch(t, []string{"mount foo", "mount bar"}, calls, "single mount of foo")
+	foo, err := d.Get(&volume.GetRequest{Name: "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, foo.Volume.Status["connections"])
+
+	fake.Lock()
+	fake.MountErr = &driver.TimeoutError{Op: driver.OpMount, Command: "rclone mount /fail", Timeout: 30 * time.Second}
+	fake.Unlock()
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = d.Mount(&volume.MountRequest{Name: "fail", ID: fmt.Sprintf("f%d", i)})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.Error(t, err)
+	}
+	assert.Equal(t, append(calls, "mount fail"), fake.Calls())
+	fail, err := d.Get(&volume.GetRequest{Name: "fail"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, fail.Volume.Status["connections"])
+}
+
+func TestCloseCancelMount(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	fake := driver.NewFakeMounter()
+	fake.Delay = time.Minute
+	d, err := driver.Init(t.TempDir(), driver.WithMounter(fake))
+	assert.NoError(t, err)
+
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"remote": ":local:/tmp/foo"}}))
+	time.AfterFunc(100*time.Millisecond, d.Close)
+	start := time.Now()
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	foo, err := d.Get(&volume.GetRequest{Name: "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, foo.Volume.Status["connections"])
+}
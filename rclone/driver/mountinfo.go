@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	//MountInfoFile file listing mounts of the current process namespace
+	MountInfoFile = "/proc/self/mountinfo"
+	//MountPollInterval interval between two mount table check while waiting for a mount in milliseconds
+	MountPollInterval = 250
+)
+
+const rcloneFSType = "fuse.rclone"
+
+//mountInfo represent a line of /proc/self/mountinfo
+type mountInfo struct {
+	MountPoint string
+	FSType     string
+	Source     string
+	Options    string
+}
+
+//readMountInfo parse the mount table of the current process namespace
+func readMountInfo() ([]mountInfo, error) {
+	f, err := os.Open(MountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+//parseMountInfo parse mountinfo format (see proc(5))
+//36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("invalid mountinfo line: %s", scanner.Text())
+		}
+		mounts = append(mounts, mountInfo{
+			MountPoint: unescapeMountPath(fields[4]),
+			Options:    fields[5],
+			FSType:     fields[sep+1],
+			Source:     unescapeMountPath(fields[sep+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+//unescapeMountPath decode octal escapes (\040 for space, ...) used by the kernel in mount table
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+//findMount return the last mount entry (the visible one) at path or nil if none
+func findMount(path string) (*mountInfo, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	var found *mountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == path {
+			found = &mounts[i]
+		}
+	}
+	return found, nil
+}
+
+//isRcloneMounted check if a rclone fuse mount is present at path
+func isRcloneMounted(path string) (bool, error) {
+	mi, err := findMount(path)
+	if err != nil {
+		return false, err
+	}
+	return mi != nil && mi.FSType == rcloneFSType, nil
+}
+
+//listRcloneMounts return the paths of rclone fuse mounts
+func listRcloneMounts() ([]string, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, mi := range mounts {
+		if mi.FSType == rcloneFSType {
+			paths = append(paths, mi.MountPoint)
+		}
+	}
+	return paths, nil
+}
+
+//waitMounted wait for the rclone process p to mount path until ctx is done
+func waitMounted(ctx context.Context, p *rcloneProcess, path string) error {
+	ticker := time.NewTicker(time.Duration(MountPollInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		mounted, err := isRcloneMounted(path)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			log.Debug().Msgf("Mount ready: %s after %v", path, time.Since(p.StartedAt()))
+			return nil
+		}
+		select {
+		case <-p.Done():
+			_, exitErr := p.ExitStatus()
+			code := 0
+			if e, ok := exitErr.(*exec.ExitError); ok {
+				code = e.ExitCode()
+			}
+			return &ExitError{Op: OpMount, Command: "rclone mount " + path, Code: code, Output: p.Output()}
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return &TimeoutError{Op: OpMount, Command: "rclone mount " + path, Timeout: commandTimeout(OpMount), Output: p.Output()}
+			}
+			return fmt.Errorf("mount of %s cancelled: %w", path, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		mounts []mountInfo
+		err    string
+	}{
+		{
+			name:   "empty",
+			input:  "",
+			mounts: nil,
+		},
+		{
+			name:  "without optional fields",
+			input: "36 35 98:0 / /mnt rw,noatime - ext3 /dev/root rw,errors=continue\n",
+			mounts: []mountInfo{
+				{MountPoint: "/mnt", FSType: "ext3", Source: "/dev/root", Options: "rw,noatime"},
+			},
+		},
+		{
+			name:  "with optional fields",
+			input: "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 shared:2 propagate_from:3 - fuse.rclone remote:bucket rw,user_id=0\n",
+			mounts: []mountInfo{
+				{MountPoint: "/mnt2", FSType: "fuse.rclone", Source: "remote:bucket", Options: "rw,noatime"},
+			},
+		},
+		{
+			name:  "escaped paths",
+			input: `40 35 0:50 / /var/lib/my\040volume rw - fuse.rclone my\011remote:a\134b rw` + "\n" + `41 35 0:51 / /trailing\04 rw - tmpfs tmpfs rw`,
+			mounts: []mountInfo{
+				{MountPoint: "/var/lib/my volume", FSType: "fuse.rclone", Source: "my\tremote:a\\b", Options: "rw"},
+				{MountPoint: `/trailing\04`, FSType: "tmpfs", Source: "tmpfs", Options: "rw"},
+			},
+		},
+		{
+			name:  "invalid escape kept",
+			input: `42 35 0:52 / /mnt\999 rw - tmpfs tmpfs rw`,
+			mounts: []mountInfo{
+				{MountPoint: `/mnt\999`, FSType: "tmpfs", Source: "tmpfs", Options: "rw"},
+			},
+		},
+		{
+			name:  "missing separator",
+			input: "36 35 98:0 / /mnt rw ext3 /dev/root rw\n",
+			err:   "invalid mountinfo line: 36 35 98:0 / /mnt rw ext3 /dev/root rw",
+		},
+		{
+			name:  "separator too early",
+			input: "36 35 98:0 / - ext3 /dev/root rw\n",
+			err:   "invalid mountinfo line: 36 35 98:0 / - ext3 /dev/root rw",
+		},
+		{
+			name:  "short line after separator",
+			input: "36 35 98:0 / /mnt rw - ext3\n",
+			err:   "invalid mountinfo line: 36 35 98:0 / /mnt rw - ext3",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mounts, err := parseMountInfo(strings.NewReader(test.input))
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.mounts, mounts)
+		})
+	}
+}
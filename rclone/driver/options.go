@@ -0,0 +1,271 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type optionKind int
+
+const (
+	boolOption optionKind = iota
+	intOption
+	octalOption
+	durationOption
+	sizeOption
+	enumOption
+)
+
+type optionSpec struct {
+	kind   optionKind
+	values []string //Allowed values of enumOption
+}
+
+var (
+	//reservedOptions options of volume create that are not rclone mount flags
+	reservedOptions = map[string]bool{
+		"config":          true,
+		"remote":          true,
+		"args":            true,
+		"subpath":         true,
+		"create_subpath":  true,
+		"purge_on_remove": true,
+	}
+	//mountOptions rclone flags allowed as volume option (key is the flag name with '_' in place of '-')
+	mountOptions = map[string]optionSpec{
+		"read_only":                 {kind: boolOption},
+		"allow_other":               {kind: boolOption},
+		"allow_root":                {kind: boolOption},
+		"allow_non_empty":           {kind: boolOption},
+		"default_permissions":       {kind: boolOption},
+		"no_modtime":                {kind: boolOption},
+		"no_checksum":               {kind: boolOption},
+		"fast_list":                 {kind: boolOption},
+		"uid":                       {kind: intOption},
+		"gid":                       {kind: intOption},
+		"transfers":                 {kind: intOption},
+		"checkers":                  {kind: intOption},
+		"umask":                     {kind: octalOption},
+		"dir_perms":                 {kind: octalOption},
+		"file_perms":                {kind: octalOption},
+		"dir_cache_time":            {kind: durationOption},
+		"poll_interval":             {kind: durationOption},
+		"attr_timeout":              {kind: durationOption},
+		"vfs_cache_max_age":         {kind: durationOption},
+		"vfs_cache_poll_interval":   {kind: durationOption},
+		"vfs_write_back":            {kind: durationOption},
+		"buffer_size":               {kind: sizeOption},
+		"max_read_ahead":            {kind: sizeOption},
+		"vfs_cache_max_size":        {kind: sizeOption},
+		"vfs_read_chunk_size":       {kind: sizeOption},
+		"vfs_read_chunk_size_limit": {kind: sizeOption},
+		"vfs_cache_mode":            {kind: enumOption, values: []string{"off", "minimal", "writes", "full"}},
+	}
+	durationRegexp = regexp.MustCompile(`^(off|0|([0-9]*\.?[0-9]+(ns|us|µs|ms|s|m|h|d|w|M|y))+)$`)
+	sizeRegexp     = regexp.MustCompile(`^(off|[0-9]*\.?[0-9]+([bBkKmMgGtTpP](i?[bB])?)?)$`)
+)
+
+//validateOption check and normalize the value of a mount option
+func validateOption(key, value string) (string, error) {
+	spec, ok := mountOptions[key]
+	if !ok {
+		return "", fmt.Errorf("unsupported option %s", key)
+	}
+	switch spec.kind {
+	case boolOption:
+		if value == "" {
+			return "true", nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid boolean %q for option %s", value, key)
+		}
+		return strconv.FormatBool(b), nil
+	case intOption:
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return "", fmt.Errorf("invalid positive integer %q for option %s", value, key)
+		}
+	case octalOption:
+		if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+			return "", fmt.Errorf("invalid octal %q for option %s", value, key)
+		}
+	case durationOption:
+		if !durationRegexp.MatchString(value) {
+			return "", fmt.Errorf("invalid duration %q for option %s", value, key)
+		}
+	case sizeOption:
+		if !sizeRegexp.MatchString(value) {
+			return "", fmt.Errorf("invalid size %q for option %s", value, key)
+		}
+	case enumOption:
+		for _, allowed := range spec.values {
+			if value == allowed {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("invalid value %q for option %s (allowed: %s)", value, key, strings.Join(spec.values, ", "))
+	}
+	return value, nil
+}
+
+//parseSubpath return the normalized subpath option (relative, without ..) and if it should be created on the remote
+func parseSubpath(opts map[string]string) (string, bool, error) {
+	subpath := strings.TrimPrefix(path.Clean("/"+opts["subpath"]), "/")
+	create, err := parseBoolOption(opts, "create_subpath")
+	if err != nil {
+		return "", false, err
+	}
+	if create && subpath == "" {
+		return "", false, fmt.Errorf("create_subpath option requires subpath option")
+	}
+	return subpath, create, nil
+}
+
+//parseBoolOption return the value of a boolean driver option, true if set without value
+func parseBoolOption(opts map[string]string, key string) (bool, error) {
+	value, ok := opts[key]
+	if !ok {
+		return false, nil
+	}
+	if value == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean %q for option %s", value, key)
+	}
+	return b, nil
+}
+
+//parseVolumeOptions validate the options of a volume create request and return the rclone mount options
+//The legacy args option is parsed and merged, individual options take precedence over it.
+func parseVolumeOptions(opts map[string]string) (map[string]string, error) {
+	parsed, err := parseArgs(opts["args"])
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range opts {
+		if reservedOptions[key] {
+			continue
+		}
+		parsed[key], err = validateOption(key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+//parseArgs convert a rclone flags string (ex: "--uid 33 --allow-other") to mount options
+func parseArgs(args string) (map[string]string, error) {
+	opts := make(map[string]string)
+	tokens, err := splitArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if !strings.HasPrefix(token, "--") {
+			return nil, fmt.Errorf("unexpected argument %q in args", token)
+		}
+		flag, value := strings.TrimPrefix(token, "--"), ""
+		hasValue := false
+		if idx := strings.Index(flag, "="); idx >= 0 {
+			flag, value, hasValue = flag[:idx], flag[idx+1:], true
+		}
+		key := strings.ReplaceAll(flag, "-", "_")
+		spec, ok := mountOptions[key]
+		if !ok {
+			return nil, fmt.Errorf("unsupported flag --%s in args", flag)
+		}
+		if !hasValue && spec.kind != boolOption {
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("missing value for flag --%s in args", flag)
+			}
+			i++
+			value = tokens[i]
+		}
+		if opts[key], err = validateOption(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+//splitArgs split a string in arguments like a shell would do for simple quoting (no expansion)
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg, escaped := false, false
+	var quote rune
+	for _, c := range s {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in args")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+//buildMountArgs convert validated mount options to rclone flags (sorted for a stable command line)
+func buildMountArgs(opts map[string]string) []string {
+	keys := make([]string, 0, len(opts))
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var args []string
+	for _, key := range keys {
+		flag := "--" + strings.ReplaceAll(key, "_", "-")
+		if mountOptions[key].kind == boolOption {
+			if opts[key] == "true" {
+				args = append(args, flag)
+			} else {
+				args = append(args, flag+"="+opts[key])
+			}
+			continue
+		}
+		args = append(args, flag, opts[key])
+	}
+	return args
+}
+
+//optionsError is returned when the stored options of a volume are not valid anymore
+type optionsError struct {
+	Volume string
+	Err    error
+}
+
+func (e *optionsError) Error() string {
+	return fmt.Sprintf("invalid options of volume %s: %v", e.Volume, e.Err)
+}
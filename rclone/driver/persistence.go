@@ -0,0 +1,221 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	persistenceFile = "persistence.json"
+	backupSuffix    = ".bak"
+)
+
+//RclonePersistence represent struct of persistence file
+type RclonePersistence struct {
+	Version int                          `json:"version"`
+	Volumes map[string]*rcloneVolume     `json:"volumes"`
+	Mounts  map[string]*rcloneMountpoint `json:"mounts"`
+}
+
+//persistencePath return the path of the persistence file
+func persistencePath() string {
+	return filepath.Join(CfgFolder, persistenceFile)
+}
+
+//saveConfig write the state to the persistence file
+//It must be called without the driver lock: the state is encoded under the lock and written outside of it.
+func (d *RcloneDriver) saveConfig() error {
+	d.Lock()
+	b, err := json.Marshal(RclonePersistence{Version: CfgVersion, Volumes: d.volumes, Mounts: d.mounts})
+	d.saveGeneration++
+	generation := d.saveGeneration
+	d.Unlock()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to encode persistence struct")
+		return err
+	}
+
+	d.saveLock.Lock()
+	defer d.saveLock.Unlock()
+	if generation < d.savedGeneration {
+		return nil //A newer state is already written
+	}
+	fi, err := os.Lstat(CfgFolder)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(CfgFolder, 0700); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if fi != nil && !fi.IsDir() {
+		return fmt.Errorf("%v already exist and it's not a directory", CfgFolder)
+	}
+	if err := writeFileAtomic(persistencePath(), b, 0600, true); err != nil {
+		log.Warn().Err(err).Msg("Unable to write persistence struct")
+		return err
+	}
+	d.savedGeneration = generation
+	return nil
+}
+
+//loadConfig read the persistence file falling back to its backup if the primary is missing or corrupt
+//Older versions are migrated (a copy of the original file is kept), newer versions and failed migrations are refused.
+//The returned boolean is set when the content has been migrated and need to be saved.
+func loadConfig() (*RclonePersistence, bool, error) {
+	path := persistencePath()
+	p, version, err := readPersistence(path)
+	if err != nil {
+		if unrecoverable(err) {
+			return nil, false, err
+		}
+		if _, errBak := os.Stat(path + backupSuffix); os.IsNotExist(err) && os.IsNotExist(errBak) {
+			return nil, false, err //Nothing to load
+		}
+		log.Error().Err(err).Msgf("Unable to read persistence file %s, trying its backup", path)
+		var errBak error
+		path = path + backupSuffix
+		p, version, errBak = readPersistence(path)
+		if unrecoverable(errBak) {
+			return nil, false, errBak
+		}
+		if errBak != nil {
+			return nil, false, fmt.Errorf("unable to read persistence file (%v) and its backup (%v)", err, errBak)
+		}
+		log.Warn().Msgf("Persistence restored from backup %s", path)
+	}
+	if version == CfgVersion {
+		return p, false, nil
+	}
+	dst := fmt.Sprintf("%s.v%d%s", persistencePath(), version, backupSuffix)
+	if err := copyFile(path, dst); err != nil {
+		return nil, false, fmt.Errorf("unable to backup persistence before migration: %v", err)
+	}
+	log.Info().Msgf("Persistence migrated from version %d to %d, previous file kept as %s", version, CfgVersion, dst)
+	return p, true, nil
+}
+
+//readPersistence decode a persistence file and return the version it was written with
+func readPersistence(path string) (*RclonePersistence, int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	p, version, err := decodePersistence(b)
+	if err != nil {
+		if unrecoverable(err) {
+			return nil, version, err
+		}
+		return nil, version, fmt.Errorf("unable to decode %s: %v", path, err)
+	}
+	return p, version, nil
+}
+
+//setAsideCorruptConfig rename unreadable persistence files to keep them for manual recovery
+func setAsideCorruptConfig() {
+	suffix := fmt.Sprintf(".corrupt-%d", time.Now().Unix())
+	for _, path := range []string{persistencePath(), persistencePath() + backupSuffix} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Rename(path, path+suffix); err != nil {
+			log.Error().Err(err).Msgf("Unable to set aside %s", path)
+		} else {
+			log.Warn().Msgf("Unreadable %s moved to %s", path, path+suffix)
+		}
+	}
+}
+
+//writeFileAtomic write data to a temporary file synced on disk and rename it over path
+//If backup is set the previous content of path is kept as path.bak
+func writeFileAtomic(path string, data []byte, perm os.FileMode, backup bool) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //No-op after rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if backup {
+		if err := backupFile(path, path+backupSuffix); err != nil {
+			log.Warn().Err(err).Msgf("Unable to backup %s", path)
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+//backupFile keep the current generation of path at dst without a window where path is missing
+func backupFile(path, dst string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !json.Valid(b) {
+		return fmt.Errorf("not overwriting backup with invalid content of %s", path)
+	}
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	if err := os.Link(path, tmp); err != nil { //Fallback to copy if hard link is not possible
+		if err := copyFile(path, tmp); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+//syncDir fsync a directory to persist a rename
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
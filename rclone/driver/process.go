@@ -0,0 +1,341 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	//StopTimeout time to wait after SIGTERM before killing a rclone process in seconds
+	StopTimeout = 10
+	//OutputTailLines number of lines of process output kept in memory for error reporting
+	OutputTailLines = 20
+)
+
+//rcloneLogLevels zerolog level of rclone log levels
+var rcloneLogLevels = map[string]zerolog.Level{
+	"debug":    zerolog.DebugLevel,
+	"info":     zerolog.InfoLevel,
+	"notice":   zerolog.InfoLevel,
+	"warning":  zerolog.WarnLevel,
+	"error":    zerolog.ErrorLevel,
+	"critical": zerolog.ErrorLevel,
+}
+
+//outputLog re-emit the output of a process line by line through a logger and keep the last lines
+type outputLog struct {
+	sync.Mutex
+	logger  zerolog.Logger
+	file    io.Writer //Raw output copy (optional)
+	partial []byte
+	lines   []string
+}
+
+func newOutputLog(logger zerolog.Logger, file io.Writer) *outputLog {
+	return &outputLog{logger: logger, file: file}
+}
+
+//Write implement io.Writer
+func (o *outputLog) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	o.partial = append(o.partial, p...)
+	for {
+		idx := bytes.IndexByte(o.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(o.partial[:idx]))
+		o.partial = o.partial[idx+1:]
+		if line == "" {
+			continue
+		}
+		if o.file != nil {
+			if _, err := fmt.Fprintln(o.file, line); err != nil {
+				o.logger.Warn().Err(err).Msg("Unable to write to log file")
+				o.file = nil
+			}
+		}
+		o.emit(line)
+	}
+	return len(p), nil
+}
+
+//emit log a line of output and keep it in the tail
+//Lines of rclone --use-json-log are decoded, others are parsed as text logs (ex: "2020/12/01 10:00:00 ERROR : msg").
+func (o *outputLog) emit(line string) {
+	level, msg, source := zerolog.InfoLevel, line, ""
+	var entry struct {
+		Level  string `json:"level"`
+		Msg    string `json:"msg"`
+		Source string `json:"source"`
+		Object string `json:"object"`
+	}
+	if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &entry) == nil && entry.Msg != "" {
+		if l, ok := rcloneLogLevels[strings.ToLower(entry.Level)]; ok {
+			level = l
+		}
+		msg, source = entry.Msg, entry.Source
+		if entry.Object != "" {
+			msg = entry.Object + ": " + msg
+		}
+	} else if fields := strings.SplitN(line, " : ", 2); len(fields) == 2 {
+		words := strings.Fields(fields[0])
+		if len(words) > 0 {
+			if l, ok := rcloneLogLevels[strings.ToLower(words[len(words)-1])]; ok {
+				level, msg = l, fields[1]
+			}
+		}
+	}
+	event := o.logger.WithLevel(level)
+	if source != "" {
+		event = event.Str("source", source)
+	}
+	event.Msg(msg)
+	o.lines = append(o.lines, level.String()+": "+msg)
+	if len(o.lines) > OutputTailLines {
+		o.lines = o.lines[len(o.lines)-OutputTailLines:]
+	}
+}
+
+//String return the last lines of output
+func (o *outputLog) String() string {
+	o.Lock()
+	defer o.Unlock()
+	lines := o.lines
+	if partial := strings.TrimSpace(string(o.partial)); partial != "" {
+		lines = append(lines[:len(lines):len(lines)], partial)
+	}
+	return strings.Join(lines, "\n")
+}
+
+//rcloneProcess supervise a rclone process started by the driver
+type rcloneProcess struct {
+	sync.RWMutex
+	cmd       *exec.Cmd
+	pid       int
+	startedAt time.Time
+	exitedAt  time.Time
+	exitErr   error
+	output    *outputLog
+	done      chan struct{}
+}
+
+//startProcess launch the command and start reaping it in background
+//stdout and stderr of the process are logged through logger, copied to file if not nil and their last lines kept
+func startProcess(cmd *exec.Cmd, logger zerolog.Logger, file io.Writer) (*rcloneProcess, error) {
+	output := newOutputLog(logger, file)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	args := make([]string, len(cmd.Args)-1)
+	for i, arg := range cmd.Args[1:] {
+		args[i] = redactRemote(arg)
+	}
+	log.Debug().Msgf("Starting process: %s %v", cmd.Path, args)
+	if err := cmd.Start(); err != nil {
+		return nil, startError(cmd.Path, err)
+	}
+	p := &rcloneProcess{
+		cmd:       cmd,
+		pid:       cmd.Process.Pid,
+		startedAt: time.Now(),
+		output:    output,
+		done:      make(chan struct{}),
+	}
+	go p.wait()
+	return p, nil
+}
+
+//wait reap the process and record its exit status
+func (p *rcloneProcess) wait() {
+	err := p.cmd.Wait()
+	p.Lock()
+	p.exitedAt = time.Now()
+	p.exitErr = err
+	p.Unlock()
+	log.Debug().Err(err).Msgf("Process %d exited", p.pid)
+	close(p.done)
+}
+
+//PID return the pid of the process
+func (p *rcloneProcess) PID() int {
+	return p.pid
+}
+
+//StartedAt return the start time of the process
+func (p *rcloneProcess) StartedAt() time.Time {
+	return p.startedAt
+}
+
+//Done return a channel closed when the process exit
+func (p *rcloneProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+//Output return the last output of the process
+func (p *rcloneProcess) Output() string {
+	return p.output.String()
+}
+
+//Running return true if the process has not exited
+func (p *rcloneProcess) Running() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+//ExitStatus return the exit time and error of the process (zero time if still running)
+func (p *rcloneProcess) ExitStatus() (time.Time, error) {
+	p.RLock()
+	defer p.RUnlock()
+	return p.exitedAt, p.exitErr
+}
+
+//Stop terminate the process with SIGTERM then SIGKILL if it doesn't exit in time
+func (p *rcloneProcess) Stop() error {
+	if !p.Running() {
+		return nil
+	}
+	log.Debug().Msgf("Sending SIGTERM to process %d", p.pid)
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil && p.Running() {
+		log.Warn().Err(err).Msgf("Unable to send SIGTERM to process %d", p.pid)
+	}
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(time.Duration(StopTimeout) * time.Second):
+	}
+	log.Warn().Msgf("Process %d didn't stop after %ds, sending SIGKILL", p.pid, StopTimeout)
+	if err := p.cmd.Process.Kill(); err != nil && p.Running() {
+		return fmt.Errorf("unable to kill process %d: %v", p.pid, err)
+	}
+	<-p.done
+	return nil
+}
+
+//logArgs return the rclone flags making its logs parsable by outputLog
+func logArgs() []string {
+	args := []string{"--use-json-log"}
+	if zerolog.GlobalLevel() == zerolog.DebugLevel {
+		args = append(args, "-v")
+	}
+	return args
+}
+
+//processMounter mount each remote with its own rclone mount process
+type processMounter struct {
+	sync.Mutex
+	processes map[string]*rcloneProcess //By mount path
+}
+
+//NewProcessMounter return a Mounter starting a rclone mount process per mount
+func NewProcessMounter() Mounter {
+	return &processMounter{processes: make(map[string]*rcloneProcess)}
+}
+
+//process implement processTracker
+func (pm *processMounter) process(path string) *rcloneProcess {
+	pm.Lock()
+	defer pm.Unlock()
+	return pm.processes[path]
+}
+
+//stopProcess terminate the rclone process serving path if any
+func (pm *processMounter) stopProcess(path string) error {
+	pm.Lock()
+	p, ok := pm.processes[path]
+	delete(pm.processes, path)
+	pm.Unlock()
+	if !ok {
+		return nil
+	}
+	err := p.Stop()
+	_, exitErr := p.ExitStatus()
+	log.Debug().Err(exitErr).Msgf("rclone process %d of %s stopped", p.PID(), path)
+	return err
+}
+
+//Mount implement Mounter
+func (pm *processMounter) Mount(ctx context.Context, spec MountSpec) error {
+	//Clean up a previous process that may still be running without a working mount
+	if err := pm.stopProcess(spec.Path); err != nil {
+		return err
+	}
+	configPath := sharedConfigPath()
+	if spec.Config != "" {
+		var err error
+		configPath, err = writeConfigFile(spec.Name, spec.Config)
+		if err != nil {
+			return fmt.Errorf("unable to write config of %s: %v", spec.Name, err)
+		}
+	}
+	args := append([]string{"--config", configPath}, logArgs()...)
+	args = append(args, buildMountArgs(spec.Options)...)
+	args = append(args, "mount", spec.Remote, spec.Path)
+
+	logger := log.With().Str("volume", spec.Volume).Str("remote", redactRemote(spec.Remote)).Logger()
+	p, err := startProcess(rcloneCommand(args...), logger, mountLog(spec.Name))
+	if err != nil {
+		if err := shredConfigFile(spec.Name); err != nil {
+			log.Warn().Err(err).Msgf("Unable to shred config of %s", spec.Name)
+		}
+		return err
+	}
+	pm.Lock()
+	pm.processes[spec.Path] = p
+	pm.Unlock()
+
+	ctx, cancel := commandContext(ctx, OpMount)
+	defer cancel()
+	if err := waitMounted(ctx, p, spec.Path); err != nil {
+		if err := pm.stopProcess(spec.Path); err != nil {
+			log.Warn().Err(err).Msgf("Unable to stop rclone process of %s", spec.Path)
+		}
+		if err := shredConfigFile(spec.Name); err != nil {
+			log.Warn().Err(err).Msgf("Unable to shred config of %s", spec.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+//Unmount implement Mounter
+func (pm *processMounter) Unmount(ctx context.Context, spec MountSpec) error {
+	mounted, err := isRcloneMounted(spec.Path)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err := unmountPath(ctx, spec.Path); err != nil {
+			return err
+		}
+	}
+	if err := pm.stopProcess(spec.Path); err != nil {
+		return err
+	}
+	return shredConfigFile(spec.Name)
+}
+
+//IsMounted implement Mounter
+func (pm *processMounter) IsMounted(path string) (bool, error) {
+	return isRcloneMounted(path)
+}
+
+//List implement Mounter
+func (pm *processMounter) List() ([]string, error) {
+	return listRcloneMounts()
+}
@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+//purgeFolder prefix of the runtime folders holding the config used to purge (not a valid mount name to avoid collisions)
+const purgeFolder = "_purge-"
+
+//joinRemote return the remote path of the subpath of remote
+func joinRemote(remote, subpath string) string {
+	if subpath == "" || strings.HasSuffix(remote, ":") || strings.HasSuffix(remote, "/") {
+		return remote + subpath
+	}
+	return remote + "/" + subpath
+}
+
+//purgeTarget return the remote path to delete at the removal of the volume
+//It refuses to purge the root of a remote or a path overlapping the data of any other volume (same path, parent or child).
+//It must be called with the driver lock held.
+func (d *RcloneDriver) purgeTarget(name string, v *rcloneVolume) (string, error) {
+	target := cleanRemote(joinRemote(v.Remote, v.Subpath))
+	if _, p := splitRemote(target); p == "" || p == "/" || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("refusing to purge the root of remote %s", redactRemote(target))
+	}
+	names := make([]string, 0, len(d.volumes))
+	for other := range d.volumes {
+		names = append(names, other)
+	}
+	sort.Strings(names)
+	for _, other := range names {
+		o := d.volumes[other]
+		if other != name && remotesOverlap(target, joinRemote(o.Remote, o.Subpath)) {
+			return "", fmt.Errorf("refusing to purge %s used by volume %s", redactRemote(target), other)
+		}
+	}
+	return target, nil
+}
+
+//splitRemote split a remote path into its remote prefix (name: or :backend,params:) and its path
+//The prefix is empty for a local path.
+func splitRemote(remote string) (string, string) {
+	var quote rune
+	for i, c := range remote {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ':' && i > 0:
+			return remote[:i+1], remote[i+1:]
+		case c == '/' || c == '\\':
+			return "", remote
+		}
+	}
+	if strings.HasPrefix(remote, ":") {
+		return remote, "" //Backend without path
+	}
+	return "", remote
+}
+
+//remotesOverlap check if one of the remote paths is the same as or contains the other
+func remotesOverlap(a, b string) bool {
+	a, b = cleanRemote(a), cleanRemote(b)
+	return a == b || remoteContains(a, b) || remoteContains(b, a)
+}
+
+//remoteContains check if the remote path child is inside parent
+func remoteContains(parent, child string) bool {
+	if strings.HasSuffix(parent, ":") || strings.HasSuffix(parent, "/") {
+		return strings.HasPrefix(child, parent)
+	}
+	return strings.HasPrefix(child, parent+"/")
+}
+
+//cleanRemote normalize the path of a remote (no trailing slash, . or ..), its root being an empty path
+func cleanRemote(remote string) string {
+	prefix, p := splitRemote(remote)
+	if p == "" {
+		return prefix
+	}
+	p = path.Clean(p)
+	if p == "." {
+		p = ""
+	}
+	return prefix + p
+}
+
+//purgeRemote delete the remote path and all its content with rclone purge
+//The config is written in a folder of the mountpoint so concurrent removals of other mountpoints don't share it.
+func purgeRemote(ctx context.Context, mount, target, config string) error {
+	configPath := sharedConfigPath()
+	if config != "" {
+		dir := purgeFolder + mount
+		path, err := writeConfigFile(dir, config)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := removeRuntimeDir(dir); err != nil {
+				log.Warn().Err(err).Msg("Unable to remove purge config")
+			}
+		}()
+		configPath = path
+	}
+	log.Info().Msgf("Purging %s", redactRemote(target))
+	if _, err := runCommand(ctx, OpPurge, rcloneBinary(), "purge", target, "--config", configPath); err != nil {
+		return fmt.Errorf("unable to purge %s: %w", redactRemote(target), err)
+	}
+	return nil
+}
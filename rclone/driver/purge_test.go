@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurgeTarget(t *testing.T) {
+	tests := []struct {
+		remote  string
+		subpath string
+		target  string
+		err     string
+	}{
+		{remote: "remote:", err: "refusing to purge the root of remote remote:"},
+		{remote: "sftp:/", err: "refusing to purge the root of remote sftp:/"},
+		{remote: "/", err: "refusing to purge the root of remote /"},
+		{remote: "//", err: "refusing to purge the root of remote /"},
+		{remote: ":local:/", err: "refusing to purge the root of remote :local:/"},
+		{remote: ":local:", err: "refusing to purge the root of remote :local:"},
+		{remote: ":memory:", err: "refusing to purge the root of remote :memory:"},
+		{remote: "remote:.", err: "refusing to purge the root of remote remote:"},
+		{remote: "remote:a/..", err: "refusing to purge the root of remote remote:"},
+		{remote: "remote:", subpath: "a/../", err: "refusing to purge the root of remote remote:"},
+		{remote: "remote:..", err: "refusing to purge the root of remote remote:.."},
+		{remote: "/tmp/..", err: "refusing to purge the root of remote /"},
+		{remote: ":s3,secret_access_key='c:d':/", err: "refusing to purge the root of remote :s3,secret_access_key=<redacted>:/"},
+		{remote: "remote:bucket/", target: "remote:bucket"},
+		{remote: "remote:bucket", subpath: "a/./b", target: "remote:bucket/a/b"},
+		{remote: ":local:/tmp/data/", target: ":local:/tmp/data"},
+		{remote: "/tmp/data", subpath: "x", target: "/tmp/data/x"},
+		{remote: ":s3,secret_access_key='c:d':bucket", target: ":s3,secret_access_key='c:d':bucket"},
+	}
+	for _, test := range tests {
+		d := newDriver(t.TempDir())
+		v := &rcloneVolume{Remote: test.remote, Subpath: test.subpath}
+		d.volumes["v"] = v
+		target, err := d.purgeTarget("v", v)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, test.remote)
+			continue
+		}
+		assert.NoError(t, err, test.remote)
+		assert.Equal(t, test.target, target, test.remote)
+	}
+}
+
+func TestRemotesOverlap(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{a: "remote:a", b: "remote:a/", overlap: true},
+		{a: "remote:a", b: "remote:a/b", overlap: true},
+		{a: "remote:a/b/..", b: "remote:a/c", overlap: true},
+		{a: "remote:", b: "remote:a", overlap: true},
+		{a: "sftp:/", b: "sftp:/home", overlap: true},
+		{a: "/", b: "/tmp", overlap: true},
+		{a: "remote:a", b: "remote:ab"},
+		{a: "remote:a", b: "other:a"},
+		{a: ":local:/tmp", b: "/tmp"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.overlap, remotesOverlap(test.a, test.b), "%s %s", test.a, test.b)
+	}
+}
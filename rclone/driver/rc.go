@@ -0,0 +1,480 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//rcFolder name of the runtime folder of the rclone rc daemon (not a valid volume name to avoid collisions)
+const rcFolder = "_rcd"
+
+//rcMountOptions path of the mount options in the rc mount/mount call
+var rcMountOptions = map[string]string{
+	"read_only":                 "vfsOpt.ReadOnly",
+	"allow_other":               "mountOpt.AllowOther",
+	"allow_root":                "mountOpt.AllowRoot",
+	"allow_non_empty":           "mountOpt.AllowNonEmpty",
+	"default_permissions":       "mountOpt.DefaultPermissions",
+	"no_modtime":                "vfsOpt.NoModTime",
+	"no_checksum":               "vfsOpt.NoChecksum",
+	"fast_list":                 "_config.UseListR",
+	"uid":                       "vfsOpt.UID",
+	"gid":                       "vfsOpt.GID",
+	"transfers":                 "_config.Transfers",
+	"checkers":                  "_config.Checkers",
+	"umask":                     "vfsOpt.Umask",
+	"dir_perms":                 "vfsOpt.DirPerms",
+	"file_perms":                "vfsOpt.FilePerms",
+	"dir_cache_time":            "vfsOpt.DirCacheTime",
+	"poll_interval":             "vfsOpt.PollInterval",
+	"attr_timeout":              "mountOpt.AttrTimeout",
+	"vfs_cache_max_age":         "vfsOpt.CacheMaxAge",
+	"vfs_cache_poll_interval":   "vfsOpt.CachePollInterval",
+	"vfs_write_back":            "vfsOpt.WriteBack",
+	"buffer_size":               "_config.BufferSize",
+	"max_read_ahead":            "mountOpt.MaxReadAhead",
+	"vfs_cache_max_size":        "vfsOpt.CacheMaxSize",
+	"vfs_read_chunk_size":       "vfsOpt.ChunkSize",
+	"vfs_read_chunk_size_limit": "vfsOpt.ChunkSizeLimit",
+	"vfs_cache_mode":            "vfsOpt.CacheMode",
+}
+
+//RcError is returned when the rclone rc API answer a call with an error
+type RcError struct {
+	Method  string
+	Status  int
+	Message string
+}
+
+func (e *RcError) Error() string {
+	return fmt.Sprintf("rc %s failed (%d): %s", e.Method, e.Status, e.Message)
+}
+
+//rcClient call the rclone remote control API
+type rcClient interface {
+	call(ctx context.Context, method string, in, out interface{}) error
+}
+
+//unixRcClient call the rclone remote control API over a unix socket
+type unixRcClient struct {
+	client *http.Client
+}
+
+func newUnixRcClient(socket string) *unixRcClient {
+	return &unixRcClient{client: unixHTTPClient(socket)}
+}
+
+//unixHTTPClient return a http client sending all requests to the unix socket
+func unixHTTPClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+//call implement rcClient
+func (c *unixRcClient) call(ctx context.Context, method string, in, out interface{}) error {
+	if in == nil {
+		in = map[string]interface{}{}
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://rclone/"+method, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		rcErr := &RcError{Method: method, Status: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			rcErr.Message = e.Error
+		}
+		return rcErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+//rcMount mount listed by the rc API
+type rcMount struct {
+	Fs         string `json:"Fs"`
+	MountPoint string `json:"MountPoint"`
+}
+
+//vfsStatsProvider is implemented by mounters reporting VFS and transfer stats of their mounts
+type vfsStatsProvider interface {
+	vfsStats(path string) (map[string]interface{}, error)
+	transferredBytes(mount string) (float64, error)
+}
+
+//rcMounter mount remotes through the rc API of a single rclone daemon
+type rcMounter struct {
+	sync.Mutex
+	socket  string
+	client  rcClient
+	process *rcloneProcess //Daemon started by the driver (nil if the rc server was already running)
+}
+
+//NewRcMounter return a Mounter using the rclone rc daemon listening on socket
+//The daemon is started if nothing answer on the socket (default in RuntimeFolder).
+func NewRcMounter(socket string) Mounter {
+	if socket == "" {
+		socket = filepath.Join(RuntimeFolder, rcFolder, "rc.sock")
+	}
+	return &rcMounter{socket: socket, client: newUnixRcClient(socket)}
+}
+
+//ensureDaemon check that the rc server is answering and start `rclone rcd` if not
+func (b *rcMounter) ensureDaemon(ctx context.Context) error {
+	b.Lock()
+	defer b.Unlock()
+	ctx, cancel := commandContext(ctx, OpRc)
+	defer cancel()
+	if err := b.client.call(ctx, "rc/noop", nil, nil); err == nil {
+		return nil
+	}
+	if b.process != nil {
+		log.Warn().Msgf("rclone rc daemon %d not answering, restarting it: %s", b.process.PID(), b.process.Output())
+		if err := b.process.Stop(); err != nil {
+			log.Warn().Err(err).Msg("Unable to stop rclone rc daemon")
+		}
+		b.process = nil
+	}
+	dir := filepath.Dir(b.socket)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Remove(b.socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	//The daemon keep the remotes created for the mounts in a private config
+	args := append([]string{"rcd", "--rc-no-auth", "--rc-addr", "unix://" + b.socket, "--config", filepath.Join(dir, configFileName)}, logArgs()...)
+	p, err := startProcess(rcloneCommand(args...), log.With().Str("process", "rcd").Logger(), logFile(rcFolder+".log"))
+	if err != nil {
+		return err
+	}
+	b.process = p
+	for {
+		if err := b.client.call(ctx, "rc/noop", nil, nil); err == nil {
+			log.Debug().Msgf("rclone rc daemon %d ready on %s", p.PID(), b.socket)
+			return nil
+		}
+		select {
+		case <-p.Done():
+			_, exitErr := p.ExitStatus()
+			b.process = nil
+			return fmt.Errorf("rclone rc daemon exited: %v: %s", exitErr, p.Output())
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return &TimeoutError{Op: OpRc, Command: "rclone rcd", Timeout: commandTimeout(OpRc), Output: p.Output()}
+			}
+			return fmt.Errorf("start of rclone rc daemon cancelled: %w", ctx.Err())
+		case <-time.After(time.Duration(MountPollInterval) * time.Millisecond):
+		}
+	}
+}
+
+//Close stop the rclone daemon if started by the mounter
+func (b *rcMounter) Close() error {
+	b.Lock()
+	defer b.Unlock()
+	if b.process == nil {
+		return nil
+	}
+	err := b.process.Stop()
+	b.process = nil
+	return err
+}
+
+//remotePrefix return the prefix of the remotes created in the daemon for a mountpoint
+func remotePrefix(mount string) string {
+	return mount + "-"
+}
+
+//statsGroup return the stats group of the transfers of a mountpoint in the daemon
+func statsGroup(mount string) string {
+	return "mount-" + mount
+}
+
+//specConfig return the rclone config used by the mount
+func specConfig(spec MountSpec) (map[string]map[string]string, error) {
+	if spec.Config != "" {
+		data, err := base64.StdEncoding.DecodeString(spec.Config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode config: %v", err)
+		}
+		return parseConfig(bytes.NewReader(data))
+	}
+	if remoteName(spec.Remote) == "" {
+		return nil, nil
+	}
+	f, err := os.Open(sharedConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseConfig(f)
+}
+
+//prefixRemote rename the remote used by value if it is a section of config
+func prefixRemote(value, prefix string, config map[string]map[string]string) (string, string) {
+	name := remoteName(value)
+	if _, ok := config[name]; !ok || name == "" {
+		return value, ""
+	}
+	return prefix + value, name
+}
+
+//createRemotes create in the daemon the remotes needed by the mount and return the remote to mount
+//Remotes are prefixed by the mount name to isolate volumes and the ones referenced by others (crypt, union, ...) are included.
+func (b *rcMounter) createRemotes(ctx context.Context, spec MountSpec) (string, error) {
+	config, err := specConfig(spec)
+	if err != nil {
+		return "", err
+	}
+	prefix := remotePrefix(spec.Name)
+	fs, name := prefixRemote(spec.Remote, prefix, config)
+	todo := []string{}
+	if name != "" {
+		todo = append(todo, name)
+	}
+	created := make(map[string]bool)
+	for len(todo) > 0 {
+		name, todo = todo[0], todo[1:]
+		if created[name] {
+			continue
+		}
+		created[name] = true
+		params := make(map[string]string)
+		for key, value := range config[name] {
+			if key == "type" {
+				continue
+			}
+			var ref string
+			params[key], ref = prefixRemote(value, prefix, config)
+			if ref != "" {
+				todo = append(todo, ref)
+			}
+		}
+		err := b.client.call(ctx, "config/create", map[string]interface{}{
+			"name":       prefix + name,
+			"type":       config[name]["type"],
+			"parameters": params,
+			"opt":        map[string]interface{}{"nonInteractive": true, "noObscure": true},
+		}, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+	return fs, nil
+}
+
+//deleteRemotes remove from the daemon the remotes created for the mountpoint
+func (b *rcMounter) deleteRemotes(ctx context.Context, mount string) error {
+	var out struct {
+		Remotes []string `json:"remotes"`
+	}
+	if err := b.client.call(ctx, "config/listremotes", nil, &out); err != nil {
+		return err
+	}
+	for _, name := range out.Remotes {
+		if !strings.HasPrefix(name, remotePrefix(mount)) {
+			continue
+		}
+		if err := b.client.call(ctx, "config/delete", map[string]interface{}{"name": name}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//rcOptions convert validated mount options to the parameters of the mount/mount call
+func rcOptions(opts map[string]string) map[string]interface{} {
+	params := make(map[string]interface{})
+	for key, value := range opts {
+		path := strings.SplitN(rcMountOptions[key], ".", 2)
+		group, ok := params[path[0]].(map[string]interface{})
+		if !ok {
+			group = make(map[string]interface{})
+			params[path[0]] = group
+		}
+		switch mountOptions[key].kind {
+		case boolOption:
+			group[path[1]] = value == "true"
+		case intOption:
+			group[path[1]], _ = strconv.Atoi(value)
+		case octalOption:
+			i, _ := strconv.ParseUint(value, 8, 32)
+			group[path[1]] = i
+		default:
+			group[path[1]] = value
+		}
+	}
+	return params
+}
+
+//Mount implement Mounter
+func (b *rcMounter) Mount(ctx context.Context, spec MountSpec) error {
+	if err := b.ensureDaemon(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := commandContext(ctx, OpMount)
+	defer cancel()
+	//Clean up remotes of a previous mount
+	if err := b.deleteRemotes(ctx, spec.Name); err != nil {
+		return err
+	}
+	fs, err := b.createRemotes(ctx, spec)
+	if err != nil {
+		return fmt.Errorf("unable to create remotes of %s: %v", spec.Name, err)
+	}
+	params := rcOptions(spec.Options)
+	params["fs"] = fs
+	params["mountPoint"] = spec.Path
+	params["mountType"] = "mount"
+	params["_group"] = statsGroup(spec.Name)
+	if err := b.client.call(ctx, "mount/mount", params, nil); err != nil {
+		if err := b.deleteRemotes(ctx, spec.Name); err != nil {
+			log.Warn().Err(err).Msgf("Unable to delete remotes of %s", spec.Name)
+		}
+		return err
+	}
+	mounted, err := isRcloneMounted(spec.Path)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return fmt.Errorf("rclone rc daemon reported %s as mounted but it is not in the mount table", spec.Path)
+	}
+	return nil
+}
+
+//listMounts return the mounts served by the daemon sorted by mountpoint
+func (b *rcMounter) listMounts(ctx context.Context) ([]rcMount, error) {
+	var out struct {
+		MountPoints []rcMount `json:"mountPoints"`
+	}
+	if err := b.client.call(ctx, "mount/listmounts", nil, &out); err != nil {
+		return nil, err
+	}
+	sort.Slice(out.MountPoints, func(i, j int) bool { return out.MountPoints[i].MountPoint < out.MountPoints[j].MountPoint })
+	return out.MountPoints, nil
+}
+
+//unmount unmount the path if served by the daemon and delete the remotes of the mount
+func (b *rcMounter) unmount(ctx context.Context, mount, path string) error {
+	ctx, cancel := commandContext(ctx, OpUnmount)
+	defer cancel()
+	mounts, err := b.listMounts(ctx)
+	if err != nil {
+		return err
+	}
+	for _, mp := range mounts {
+		if mp.MountPoint == path {
+			if err := b.client.call(ctx, "mount/unmount", map[string]interface{}{"mountPoint": path}, nil); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return b.deleteRemotes(ctx, mount)
+}
+
+//Unmount implement Mounter
+//The path is unmounted with umount if the daemon is not able to do it (dead or restarted daemon).
+func (b *rcMounter) Unmount(ctx context.Context, spec MountSpec) error {
+	if err := b.unmount(ctx, spec.Name, spec.Path); err != nil {
+		log.Warn().Err(err).Msgf("Unable to unmount %s through rc, falling back to umount", spec.Path)
+	}
+	mounted, err := isRcloneMounted(spec.Path)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return unmountPath(ctx, spec.Path)
+	}
+	return nil
+}
+
+//IsMounted implement Mounter
+func (b *rcMounter) IsMounted(path string) (bool, error) {
+	return isRcloneMounted(path)
+}
+
+//List implement Mounter
+func (b *rcMounter) List() ([]string, error) {
+	ctx, cancel := commandContext(context.Background(), OpRc)
+	defer cancel()
+	mounts, err := b.listMounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(mounts))
+	for _, mp := range mounts {
+		paths = append(paths, mp.MountPoint)
+	}
+	return paths, nil
+}
+
+//vfsStats implement vfsStatsProvider
+func (b *rcMounter) vfsStats(path string) (map[string]interface{}, error) {
+	ctx, cancel := commandContext(context.Background(), OpRc)
+	defer cancel()
+	mounts, err := b.listMounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, mp := range mounts {
+		if mp.MountPoint == path {
+			stats := make(map[string]interface{})
+			err := b.client.call(ctx, "vfs/stats", map[string]interface{}{"fs": mp.Fs}, &stats)
+			return stats, err
+		}
+	}
+	return nil, fmt.Errorf("%s is not served by the rclone rc daemon", path)
+}
+
+//transferredBytes implement vfsStatsProvider
+func (b *rcMounter) transferredBytes(mount string) (float64, error) {
+	ctx, cancel := commandContext(context.Background(), OpRc)
+	defer cancel()
+	var stats struct {
+		Bytes float64 `json:"bytes"`
+	}
+	err := b.client.call(ctx, "core/stats", map[string]interface{}{"group": statsGroup(mount)}, &stats)
+	return stats.Bytes, err
+}
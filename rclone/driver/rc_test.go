@@ -0,0 +1,164 @@
+package driver_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+
+	"github.com/sapk/docker-volume-rclone/rclone/driver"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeRc in-process rclone rc server recording remotes and mounts in a fake mount table
+type fakeRc struct {
+	sync.Mutex
+	mountInfo string
+	remotes   map[string]map[string]interface{}
+	mounts    map[string]string //Mountpoint -> fs
+	groups    map[string]string //Stats group -> mountpoint
+}
+
+func newFakeRc(t *testing.T, socket, mountInfo string) *fakeRc {
+	rc := &fakeRc{mountInfo: mountInfo, remotes: map[string]map[string]interface{}{}, mounts: map[string]string{}, groups: map[string]string{}}
+	assert.NoError(t, ioutil.WriteFile(mountInfo, nil, 0600))
+	l, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	srv := httptest.NewUnstartedServer(rc)
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return rc
+}
+
+func (rc *fakeRc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.Lock()
+	defer rc.Unlock()
+	method := strings.TrimPrefix(r.URL.Path, "/")
+	var in map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, `{"error":"invalid input"}`, http.StatusBadRequest)
+		return
+	}
+	out := map[string]interface{}{}
+	switch method {
+	case "rc/noop":
+	case "config/create":
+		rc.remotes[in["name"].(string)] = in
+	case "config/delete":
+		delete(rc.remotes, in["name"].(string))
+	case "config/listremotes":
+		remotes := []string{}
+		for name := range rc.remotes {
+			remotes = append(remotes, name)
+		}
+		out["remotes"] = remotes
+	case "mount/mount":
+		fs := in["fs"].(string)
+		if name := strings.SplitN(fs, ":", 2)[0]; name != "" && rc.remotes[name] == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": "didn't find section in config file", "status": 500})
+			return
+		}
+		rc.mounts[in["mountPoint"].(string)] = fs
+		if group, ok := in["_group"].(string); ok {
+			rc.groups[group] = in["mountPoint"].(string)
+		}
+		rc.writeMountInfo()
+	case "mount/unmount":
+		delete(rc.mounts, in["mountPoint"].(string))
+		rc.writeMountInfo()
+	case "mount/listmounts":
+		list := []map[string]string{}
+		for path, fs := range rc.mounts {
+			list = append(list, map[string]string{"Fs": fs, "MountPoint": path})
+		}
+		out["mountPoints"] = list
+	case "core/stats":
+		if _, ok := rc.groups[in["group"].(string)]; !ok {
+			out["bytes"] = 0
+			break
+		}
+		out["bytes"] = 4096
+		out["transfers"] = 1
+	case "vfs/stats":
+		out["fs"] = in["fs"]
+		out["inUse"] = 1
+		out["diskCache"] = map[string]interface{}{"bytesUsed": 1024, "uploadsQueued": 2}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": "couldn't find method", "status": 404})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func (rc *fakeRc) writeMountInfo() {
+	var b strings.Builder
+	for path, fs := range rc.mounts {
+		b.WriteString(strings.Join([]string{"1", "1", "0:1", "/", path, "rw", "-", "fuse.rclone", fs, "rw\n"}, " "))
+	}
+	_ = ioutil.WriteFile(rc.mountInfo, []byte(b.String()), 0600)
+}
+
+func TestRcBackend(t *testing.T) {
+	driver.CfgFolder = filepath.Join(t.TempDir(), "config")
+	driver.RuntimeFolder = filepath.Join(t.TempDir(), "run")
+	driver.MountInfoFile = filepath.Join(t.TempDir(), "mountinfo")
+	defer func() { driver.MountInfoFile = "/proc/self/mountinfo" }()
+	socket := filepath.Join(t.TempDir(), "rc.sock")
+	rc := newFakeRc(t, socket, driver.MountInfoFile)
+
+	d, err := driver.Init(t.TempDir(), driver.WithMounter(driver.NewRcMounter(socket)))
+	assert.NoError(t, err)
+	defer d.Close()
+
+	config := base64.StdEncoding.EncodeToString([]byte("[base]\ntype = local\n\n[secret]\ntype = crypt\nremote = base:/tmp\npassword = xxx\n"))
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "crypt", Options: map[string]string{
+		"config": config, "remote": "secret:data", "read_only": "true", "umask": "022",
+	}}))
+	resp, err := d.Mount(&volume.MountRequest{Name: "crypt", ID: "c1"})
+	assert.NoError(t, err)
+
+	get, err := d.Get(&volume.GetRequest{Name: "crypt"})
+	assert.NoError(t, err)
+	prefix := get.Volume.Status["mount"].(string) + "-"
+	assert.Equal(t, "healthy", get.Volume.Status["health"])
+	assert.Equal(t, prefix+"secret:data", get.Volume.Status["vfs"].(map[string]interface{})["fs"])
+
+	rc.Lock()
+	assert.Equal(t, prefix+"secret:data", rc.mounts[resp.Mountpoint])
+	assert.Equal(t, prefix+"base:/tmp", rc.remotes[prefix+"secret"]["parameters"].(map[string]interface{})["remote"])
+	assert.Contains(t, rc.remotes, prefix+"base")
+	rc.Unlock()
+
+	rec := httptest.NewRecorder()
+	d.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), `docker_volume_rclone_vfs_cache_bytes{volume="crypt"} 1024`)
+	assert.Contains(t, rec.Body.String(), `docker_volume_rclone_vfs_uploads_queued{volume="crypt"} 2`)
+	assert.Contains(t, rec.Body.String(), `docker_volume_rclone_transferred_bytes_total{volume="crypt"} 4096`)
+	rc.Lock()
+	assert.Equal(t, resp.Mountpoint, rc.groups["mount-"+get.Volume.Status["mount"].(string)])
+	rc.Unlock()
+
+	assert.NoError(t, d.Unmount(&volume.UnmountRequest{Name: "crypt", ID: "c1"}))
+	rc.Lock()
+	assert.Empty(t, rc.mounts)
+	assert.Empty(t, rc.remotes)
+	rc.Unlock()
+
+	assert.NoError(t, d.Create(&volume.CreateRequest{Name: "unknown", Options: map[string]string{
+		"config": config, "remote": "other:data",
+	}}))
+	_, err = d.Mount(&volume.MountRequest{Name: "unknown", ID: "c2"})
+	assert.EqualError(t, err, "rc mount/mount failed (500): didn't find section in config file")
+}
@@ -0,0 +1,238 @@
+package driver
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	//HealthCheckTimeout timeout before considering a mount as not responding in seconds
+	HealthCheckTimeout = 5
+	//RemountOnStart remount at startup volumes that docker still consider as attached
+	RemountOnStart = false
+)
+
+type mountHealth int
+
+const (
+	mountAbsent       mountHealth = iota //Nothing mounted
+	mountHealthy                         //Rclone mount responding
+	mountStale                           //Rclone mount without a live process (transport endpoint is not connected)
+	mountUnresponsive                    //Rclone mount not answering in time
+	mountForeign                         //Something else than rclone is mounted
+)
+
+func (h mountHealth) String() string {
+	switch h {
+	case mountAbsent:
+		return "absent"
+	case mountHealthy:
+		return "healthy"
+	case mountStale:
+		return "stale"
+	case mountUnresponsive:
+		return "unresponsive"
+	case mountForeign:
+		return "foreign"
+	}
+	return "unknown"
+}
+
+//statProbe stat of a mount path in progress, shared by the checks of the path
+type statProbe struct {
+	done     chan struct{} //Closed when stat returned
+	err      error
+	deadline time.Time
+}
+
+//healthProbes track the stat in progress and the last health of each mount path
+//At most one stat is in flight per path so a hung fuse mount doesn't pile up goroutines.
+type healthProbes struct {
+	sync.Mutex
+	pending map[string]*statProbe
+	last    map[string]mountHealth
+}
+
+//start return the stat in progress of path or start a new one
+func (h *healthProbes) start(path string) (*statProbe, bool) {
+	h.Lock()
+	defer h.Unlock()
+	if p, ok := h.pending[path]; ok {
+		return p, true
+	}
+	if h.pending == nil {
+		h.pending = make(map[string]*statProbe)
+	}
+	p := &statProbe{done: make(chan struct{}), deadline: time.Now().Add(time.Duration(HealthCheckTimeout) * time.Second)}
+	h.pending[path] = p
+	go func() { //A hung fuse mount can block stat forever
+		_, err := os.Stat(path)
+		p.err = err
+		close(p.done)
+		h.Lock()
+		delete(h.pending, path)
+		h.Unlock()
+	}()
+	return p, false
+}
+
+//lastHealth return the last health recorded for path
+func (h *healthProbes) lastHealth(path string) (mountHealth, bool) {
+	h.Lock()
+	defer h.Unlock()
+	health, ok := h.last[path]
+	return health, ok
+}
+
+//record keep the last health of path (forgotten once unmounted)
+func (h *healthProbes) record(path string, health mountHealth) {
+	h.Lock()
+	defer h.Unlock()
+	if health == mountAbsent || health == mountForeign {
+		delete(h.last, path)
+		return
+	}
+	if h.last == nil {
+		h.last = make(map[string]mountHealth)
+	}
+	h.last[path] = health
+}
+
+//checkMount inspect the mount table and the responsiveness of path
+//While a previous stat of path is still pending its last result is returned instead of waiting again.
+func (d *RcloneDriver) checkMount(path string) (mountHealth, error) {
+	mounted, err := d.mounter.IsMounted(path)
+	if err != nil {
+		return mountAbsent, err
+	}
+	if !mounted {
+		health := mountAbsent
+		if mi, err := findMount(path); err == nil && mi != nil {
+			health = mountForeign
+		}
+		d.health.record(path, health)
+		return health, nil
+	}
+	p, pending := d.health.start(path)
+	if pending {
+		if health, ok := d.health.lastHealth(path); ok {
+			return health, nil
+		}
+	}
+	health, err := waitStat(p)
+	d.health.record(path, health)
+	return health, err
+}
+
+//waitStat wait for the result of the stat until its deadline
+func waitStat(p *statProbe) (mountHealth, error) {
+	timer := time.NewTimer(time.Until(p.deadline))
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		if p.err == nil {
+			return mountHealthy, nil
+		}
+		if errors.Is(p.err, syscall.ENOTCONN) || errors.Is(p.err, syscall.EIO) {
+			return mountStale, nil
+		}
+		return mountStale, p.err
+	case <-timer.C:
+		return mountUnresponsive, nil
+	}
+}
+
+//mountVolumes return the sorted names of volumes using a mountpoint
+func (d *RcloneDriver) mountVolumes(mount string) []string {
+	var names []string
+	for name, v := range d.volumes {
+		if v.Mount == mount {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//reconcile align the persisted mount state with the kernel mount table at startup
+func (d *RcloneDriver) reconcile() {
+	if len(d.mounts) == 0 {
+		return
+	}
+	var healthy, cleaned, remounted, reset, failed int
+	for mount, m := range d.mounts {
+		volumes := d.mountVolumes(mount)
+		if len(volumes) == 0 {
+			log.Warn().Msgf("Mountpoint %s is not used by any volume", mount)
+			continue
+		}
+		v := d.volumes[volumes[0]]
+		health, err := d.checkMount(m.Path)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Unable to check mount %s", m.Path)
+		}
+		log.Debug().Msgf("Reconcile %s: %s with connections %v", m.Path, health, m.IDs)
+		switch health {
+		case mountHealthy:
+			if len(m.IDs) > 0 { //Still in use, keep it as is
+				log.Info().Msgf("Keeping live mount %s (pid %d) not supervised by this daemon", m.Path, m.PID)
+				healthy++
+				continue
+			}
+			if err := d.stopMount(v, m); err != nil {
+				log.Warn().Err(err).Msgf("Unable to unmount unused mount %s", m.Path)
+				failed++
+				continue
+			}
+			cleaned++
+		case mountUnresponsive:
+			log.Warn().Msgf("Mount %s is not responding, leaving it as is", m.Path)
+			failed++
+			continue
+		case mountForeign:
+			log.Warn().Msgf("%s is mounted by something else than rclone, leaving it as is", m.Path)
+			failed++
+			continue
+		case mountStale:
+			log.Info().Msgf("Cleaning stale mount %s", m.Path)
+			if err := d.stopMount(v, m); err != nil {
+				log.Warn().Err(err).Msgf("Unable to clean stale mount %s", m.Path)
+				failed++
+				continue
+			}
+			cleaned++
+		case mountAbsent:
+			if err := d.stopMount(v, m); err != nil {
+				log.Warn().Err(err).Msgf("Unable to clean runtime files of %s", m.Path)
+			}
+		}
+		m.PID = 0
+		m.StartedAt = ""
+
+		if len(m.IDs) > 0 && RemountOnStart {
+			err := d.startMount(volumes[0], v, m)
+			if err == nil {
+				log.Info().Msgf("Remounted %s for connections %v", m.Path, m.IDs)
+				remounted++
+				continue
+			}
+			log.Error().Err(err).Msgf("Unable to remount %s", m.Path)
+			failed++
+		}
+		if len(m.IDs) > 0 {
+			reset++
+		}
+		m.clearRefs()
+		d.updateConnections(mount)
+	}
+	log.Info().Msgf("Reconciliation done: %d mounts, %d live, %d cleaned, %d remounted, %d reset, %d failed", len(d.mounts), healthy, cleaned, remounted, reset, failed)
+	if err := d.saveConfig(); err != nil {
+		log.Error().Err(err).Msg("Unable to save reconciled state")
+	}
+}
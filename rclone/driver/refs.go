@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	//anonymousRefPrefix prefix of references generated for mount requests without ID
+	anonymousRefPrefix = "anonymous-"
+	//legacyRefPrefix prefix of references migrated from connection counters
+	legacyRefPrefix = "legacy-"
+)
+
+//addRef register the docker mount ID of a volume on the mountpoint and return false if already known
+func (m *rcloneMountpoint) addRef(id, volume string) bool {
+	if m.IDs == nil {
+		m.IDs = make(map[string]string)
+	}
+	if id == "" { //Old docker version doesn't send ID
+		for i := 0; ; i++ {
+			id = fmt.Sprintf("%s%d", anonymousRefPrefix, i)
+			if _, ok := m.IDs[id]; !ok {
+				break
+			}
+		}
+	}
+	if _, ok := m.IDs[id]; ok {
+		return false
+	}
+	m.IDs[id] = volume
+	m.Connections = len(m.IDs)
+	return true
+}
+
+//removeRef unregister the docker mount ID of a volume and return false if unknown
+//An unknown or empty ID consume an anonymous or legacy reference of the volume if any.
+func (m *rcloneMountpoint) removeRef(id, volume string) bool {
+	defer func() { m.Connections = len(m.IDs) }()
+	if vol, ok := m.IDs[id]; ok && vol == volume {
+		delete(m.IDs, id)
+		return true
+	}
+	for _, ref := range m.volumeRefs(volume) {
+		if strings.HasPrefix(ref, anonymousRefPrefix) || strings.HasPrefix(ref, legacyRefPrefix) {
+			delete(m.IDs, ref)
+			return true
+		}
+	}
+	return false
+}
+
+//hasRef check if the docker mount ID is registered on the mountpoint
+func (m *rcloneMountpoint) hasRef(id string) bool {
+	_, ok := m.IDs[id]
+	return id != "" && ok
+}
+
+//volumeRefs return the sorted docker mount IDs of a volume on the mountpoint
+func (m *rcloneMountpoint) volumeRefs(volume string) []string {
+	var ids []string
+	for id, vol := range m.IDs {
+		if vol == volume {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//clearRefs forget all references of the mountpoint
+func (m *rcloneMountpoint) clearRefs() {
+	m.IDs = make(map[string]string)
+	m.Connections = 0
+}
+
+//updateConnections refresh the connection counters of the volumes using the mountpoint
+func (d *RcloneDriver) updateConnections(mount string) {
+	m, ok := d.mounts[mount]
+	if !ok {
+		return
+	}
+	m.Connections = len(m.IDs)
+	for _, name := range d.mountVolumes(mount) {
+		d.volumes[name].Connections = len(m.volumeRefs(name))
+	}
+}
@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+//remoteParamRegexp match parameter values of connection string remotes (ex: :s3,access_key_id=XXX:bucket)
+var remoteParamRegexp = regexp.MustCompile(`,([a-zA-Z0-9_]+)=("[^"]*"|'[^']*'|[^,:]*)`)
+
+//redactRemote hide the parameter values of a remote that may contain credentials
+func redactRemote(remote string) string {
+	return remoteParamRegexp.ReplaceAllString(remote, ",$1=<redacted>")
+}
+
+//volumeStatus describe the state of a volume and its mountpoint for docker volume inspect
+//It must be called with the driver lock held and doesn't touch the filesystem.
+func (d *RcloneDriver) volumeStatus(name string, v *rcloneVolume, m *rcloneMountpoint) map[string]interface{} {
+	status := map[string]interface{}{
+		"remote":      redactRemote(v.Remote),
+		"mount":       v.Mount,
+		"path":        m.Path,
+		"connections": v.Connections,
+		"ids":         m.volumeRefs(name),
+		"restarts":    m.Restarts,
+	}
+	if v.Subpath != "" {
+		status["subpath"] = v.Subpath
+	}
+	if v.PurgeOnRemove {
+		status["purge_on_remove"] = true
+	}
+	var sharedWith []string
+	for _, other := range d.mountVolumes(v.Mount) {
+		if other != name {
+			sharedWith = append(sharedWith, other)
+		}
+	}
+	if len(sharedWith) > 0 {
+		status["shared_with"] = sharedWith
+	}
+	if v.Config != "" {
+		status["config"] = "volume"
+	} else {
+		status["config"] = sharedConfigPath()
+	}
+	if opts, err := v.mountOptions(); err != nil {
+		status["flags"] = "invalid: " + err.Error()
+	} else {
+		status["flags"] = strings.Join(buildMountArgs(opts), " ")
+	}
+	if rcloneVersion != "" {
+		status["rclone_version"] = rcloneVersion
+	}
+	if m.LastError != "" {
+		status["last_error"] = m.LastError
+	}
+	if m.PID != 0 {
+		status["pid"] = m.PID
+	}
+	if m.StartedAt != "" {
+		if startedAt, err := time.Parse(time.RFC3339, m.StartedAt); err == nil {
+			status["started_at"] = m.StartedAt
+			status["uptime"] = time.Since(startedAt).Truncate(time.Second).String()
+		}
+	}
+	if p := d.process(m); p != nil && !p.Running() {
+		status["exit_status"] = "exited"
+		if _, exitErr := p.ExitStatus(); exitErr != nil {
+			status["exit_status"] = exitErr.Error()
+		}
+	}
+	return status
+}
+
+//addHealthStatus check the mountpoint and add its health to the status
+//It may block up to HealthCheckTimeout (once per hung mount) so it should be called without the driver lock.
+func (d *RcloneDriver) addHealthStatus(status map[string]interface{}, path string) {
+	health, err := d.checkMount(path)
+	status["health"] = health.String()
+	status["responding"] = health == mountHealthy
+	if err != nil {
+		status["health_error"] = err.Error()
+	}
+}
@@ -0,0 +1,200 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	//Scope scope of volumes advertised to docker (local or global)
+	Scope = "local"
+	//storeKeyRegexp docker volume name format (also protect from path traversal)
+	storeKeyRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+const storeFileSuffix = ".json"
+
+//Store persist volume definitions shared between nodes in global scope
+type Store interface {
+	//List return all the values by key
+	List() (map[string][]byte, error)
+	//Get return the value of key or an error satisfying os.IsNotExist
+	Get(key string) ([]byte, error)
+	//Put set the value of key
+	Put(key string, value []byte) error
+	//Delete remove key (no error if it doesn't exist)
+	Delete(key string) error
+}
+
+//fileStore store each key in a json file of a directory (that can be on a shared filesystem)
+type fileStore struct {
+	dir string
+}
+
+//NewFileStore return a Store keeping values in files of dir
+//The folder is not created as a missing one likely means the shared filesystem is not mounted.
+func NewFileStore(dir string) (Store, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", dir)
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(key string) (string, error) {
+	if !storeKeyRegexp.MatchString(key) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(s.dir, key+storeFileSuffix), nil
+}
+
+//List implement Store
+func (s *fileStore) List() (map[string][]byte, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte)
+	for _, f := range files {
+		key := strings.TrimSuffix(f.Name(), storeFileSuffix)
+		if f.IsDir() || !strings.HasSuffix(f.Name(), storeFileSuffix) || !storeKeyRegexp.MatchString(key) {
+			continue //Temporary or foreign file
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, f.Name()))
+		if os.IsNotExist(err) { //Removed in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		values[key] = b
+	}
+	return values, nil
+}
+
+//Get implement Store
+func (s *fileStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+//Put implement Store
+func (s *fileStore) Put(key string, value []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, value, 0600, false)
+}
+
+//Delete implement Store
+func (s *fileStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//storeVolume publish the volume definition in the shared store
+func (d *RcloneDriver) storeVolume(name string, v *rcloneVolume) error {
+	if d.store == nil {
+		return nil
+	}
+	def := *v
+	def.Connections = 0 //Node local
+	b, err := json.Marshal(&def)
+	if err != nil {
+		return err
+	}
+	return d.store.Put(name, b)
+}
+
+//storedVolume return the volume definition from the shared store or nil if there is none
+func (d *RcloneDriver) storedVolume(name string) (*rcloneVolume, error) {
+	if d.store == nil {
+		return nil, nil
+	}
+	b, err := d.store.Get(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var def rcloneVolume
+	if err := json.Unmarshal(b, &def); err != nil {
+		return nil, fmt.Errorf("invalid definition of volume %s in shared store: %v", name, err)
+	}
+	def.Connections = 0
+	return &def, nil
+}
+
+//unstoreVolume remove the volume definition from the shared store
+func (d *RcloneDriver) unstoreVolume(name string) error {
+	if d.store == nil {
+		return nil
+	}
+	return d.store.Delete(name)
+}
+
+//syncStore align local volumes with the definitions listed from the shared store
+//Volumes created on other nodes are added and volumes removed elsewhere are dropped if not in use (never on an empty listing).
+//It must be called with the driver lock held and return if the state changed and the mountpoints left without volume to tear down.
+func (d *RcloneDriver) syncStore(values map[string][]byte) (bool, []string) {
+	changed := false
+	for name, b := range values {
+		var def rcloneVolume
+		if err := json.Unmarshal(b, &def); err != nil {
+			log.Warn().Err(err).Msgf("Invalid definition of volume %s in shared store", name)
+			continue
+		}
+		if _, ok := d.volumes[name]; ok {
+			continue
+		}
+		if _, err := d.ensureMountpoint(def.Mount); err != nil {
+			log.Warn().Err(err).Msgf("Unable to prepare mountpoint of volume %s from shared store", name)
+			continue
+		}
+		def.Connections = 0
+		d.volumes[name] = &def
+		changed = true
+		log.Debug().Msgf("Volume %s added from shared store", name)
+	}
+	if len(values) == 0 && len(d.volumes) > 0 {
+		//An empty listing is more likely an unmounted shared folder than the removal of every volume
+		log.Warn().Msg("Shared store is empty, keeping local volumes")
+		return false, nil
+	}
+	var orphans []string
+	for name, v := range d.volumes {
+		if _, ok := values[name]; ok {
+			continue
+		}
+		if m, ok := d.mounts[v.Mount]; ok && len(m.volumeRefs(name)) > 0 {
+			log.Warn().Msgf("Volume %s removed from shared store but still in use", name)
+			continue
+		}
+		delete(d.volumes, name)
+		if _, ok := d.mounts[v.Mount]; ok && len(d.mountVolumes(v.Mount)) == 0 {
+			orphans = append(orphans, v.Mount)
+		}
+		changed = true
+		log.Debug().Msgf("Volume %s removed as not in shared store anymore", name)
+	}
+	return changed, orphans
+}
@@ -1,64 +1,25 @@
 package driver
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
+	"crypto/sha256"
+	"encoding/hex"
 
 	"github.com/docker/go-plugins-helpers/volume"
-	"github.com/rs/zerolog/log"
 )
 
-//RclonePersistence represent struct of persistence file
-type RclonePersistence struct {
-	Version int                          `json:"version"`
-	Volumes map[string]*rcloneVolume     `json:"volumes"`
-	Mounts  map[string]*rcloneMountpoint `json:"mounts"`
-}
-
-func (d *RcloneDriver) saveConfig() error {
-	fi, err := os.Lstat(CfgFolder)
-	if os.IsNotExist(err) {
-		if err = os.MkdirAll(CfgFolder, 0700); err != nil {
-			return err
-		}
-	} else if err != nil {
-		return err
-	}
-	if fi != nil && !fi.IsDir() {
-		return fmt.Errorf("%v already exist and it's not a directory", d.root)
-	}
-	b, err := json.Marshal(RclonePersistence{Version: CfgVersion, Volumes: d.volumes, Mounts: d.mounts})
-	if err != nil {
-		log.Warn().Err(err).Msg("Unable to encode persistence struct")
+//GetMountName return the name of the mountpoint of the volume, a hash of its remote, config and effective flags
+//so volumes with identical definitions share the same mountpoint (and rclone mount)
+func GetMountName(d *RcloneDriver, r *volume.CreateRequest) string {
+	var flags []string
+	if opts, err := parseVolumeOptions(r.Options); err == nil {
+		flags = buildMountArgs(opts)
+	} else {
+		flags = []string{r.Options["args"]} //Invalid options are refused by Create
 	}
-	//log.Debug("Writing persistence struct, %v", b, d.volumes)
-	err = ioutil.WriteFile(CfgFolder+"/persistence.json", b, 0600)
-	if err != nil {
-		log.Warn().Err(err).Msg("Unable to write persistence struct, %s")
+	h := sha256.New()
+	for _, part := range append([]string{r.Options["remote"], r.Options["config"]}, flags...) {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
 	}
-	//TODO display error messages
-	return err
-}
-
-// run deamon in context of this gvfs drive with custome env
-func (d *RcloneDriver) runCmd(cmd string) (context.Context, error) {
-	log.Debug().Msg(cmd)
-	/*
-		cli := exec.Command("/bin/bash", "-c", cmd)
-		stdoutStderr, err := cli.CombinedOutput()
-		log.Debugf("%s", stdoutStderr)
-		return err
-	*/
-	ctx := context.Background()
-	return ctx, exec.CommandContext(ctx, "/bin/bash", "-c", cmd).Run()
-	//TODO output log
-}
-
-//GetMountName return the translated volume name
-func GetMountName(d *RcloneDriver, r *volume.CreateRequest) string {
-	return r.Name
+	return hex.EncodeToString(h.Sum(nil))[:16]
 }
@@ -0,0 +1,154 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	//WatchdogInterval interval between two checks of mounts in use in seconds (0 to disable)
+	WatchdogInterval = 10
+	//RemountBackoffMin delay before retrying a failed remount in seconds (doubled at each failure)
+	RemountBackoffMin = 5
+	//RemountBackoffMax max delay between two remount tries in seconds
+	RemountBackoffMax = 300
+)
+
+//startWatchdog check periodically mounts in use and remount dead ones until Close is called
+func (d *RcloneDriver) startWatchdog() {
+	if WatchdogInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(WatchdogInterval) * time.Second)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-ticker.C:
+				d.watchdog()
+			}
+		}
+	}()
+}
+
+//Close stop background tasks of the driver, cancel external operations in progress and release the mounter
+func (d *RcloneDriver) Close() {
+	d.stopOnce.Do(func() {
+		d.cancel()
+		if c, ok := d.mounter.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Warn().Err(err).Msg("Unable to close mounter")
+			}
+		}
+	})
+}
+
+//watchdog remount mountpoints in use whose rclone process died
+func (d *RcloneDriver) watchdog() {
+	d.RLock()
+	var mounts []string
+	for mount, m := range d.mounts {
+		if len(m.IDs) > 0 && m.pending == 0 && !time.Now().Before(m.nextRetry) { //Mounts still starting are not checked
+			mounts = append(mounts, mount)
+		}
+	}
+	d.RUnlock()
+	changed := false
+	for _, mount := range mounts {
+		if d.watchMount(mount) {
+			changed = true
+		}
+	}
+	if changed {
+		if err := d.saveConfig(); err != nil {
+			log.Error().Err(err).Msg("Watchdog unable to save state")
+		}
+	}
+}
+
+//watchMount remount the mountpoint if its rclone process died and return true if it was remounted
+func (d *RcloneDriver) watchMount(mount string) bool {
+	d.RLock()
+	m, ok := d.mounts[mount]
+	d.RUnlock()
+	if !ok {
+		return false
+	}
+	m.lock.Lock() //Wait for mount operations in progress
+	defer m.lock.Unlock()
+
+	d.RLock()
+	volumes := d.mountVolumes(mount)
+	inUse := len(m.IDs) > 0 && m.pending == 0 && len(volumes) > 0 && d.mounts[mount] == m
+	var v *rcloneVolume
+	if inUse {
+		v = d.volumes[volumes[0]]
+	}
+	refs, startedAt, backoff := len(m.IDs), m.StartedAt, m.backoff
+	d.RUnlock()
+	if !inUse {
+		return false
+	}
+
+	reason := ""
+	if p := d.process(m); p != nil && !p.Running() {
+		_, exitErr := p.ExitStatus()
+		reason = fmt.Sprintf("rclone exited: %v: %s", exitErr, p.Output())
+	} else {
+		health, err := d.checkMount(m.Path)
+		switch {
+		case err != nil:
+			log.Warn().Err(err).Msgf("Watchdog unable to check %s", m.Path)
+			return false
+		case health == mountStale || health == mountAbsent:
+			reason = fmt.Sprintf("mount is %s", health)
+		case health == mountUnresponsive:
+			log.Warn().Msgf("Watchdog: mount %s is not responding", m.Path)
+			return false
+		}
+	}
+	if reason == "" {
+		if started, err := time.Parse(time.RFC3339, startedAt); backoff > 0 && err == nil && time.Since(started) > time.Duration(RemountBackoffMax)*time.Second {
+			d.Lock()
+			m.backoff = 0 //Stable for long enough
+			d.Unlock()
+		}
+		return false
+	}
+
+	log.Warn().Msgf("Watchdog: remounting %s used by %d connections (%s)", m.Path, refs, reason)
+	if err := d.stopMount(v, m); err != nil {
+		log.Warn().Err(err).Msgf("Watchdog unable to clean %s", m.Path)
+	}
+	err := d.startMount(volumes[0], v, m)
+	d.Lock()
+	defer d.Unlock()
+	m.LastError = reason
+	m.Restarts++
+	if err != nil {
+		log.Error().Err(err).Msgf("Watchdog unable to remount %s", m.Path)
+		m.LastError = err.Error()
+	}
+	m.backoff = nextBackoff(backoff)
+	m.nextRetry = time.Now().Add(m.backoff)
+	return true
+}
+
+//nextBackoff double the previous remount delay within the configured bounds
+func nextBackoff(previous time.Duration) time.Duration {
+	min := time.Duration(RemountBackoffMin) * time.Second
+	max := time.Duration(RemountBackoffMax) * time.Second
+	next := previous * 2
+	if next < min {
+		next = min
+	}
+	if next > max {
+		next = max
+	}
+	return next
+}
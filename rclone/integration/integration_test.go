@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"os/user"
 	"path/filepath"
 	"testing"
@@ -31,6 +32,14 @@ const (
 	capabilitiesPath = "/VolumeDriver.Capabilities"
 )
 
+//fakeRclone install a fake rclone binary answering to version and use it through RCLONE_BINARY
+func fakeRclone(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "rclone")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\necho rclone v1.53.3\n"), 0700))
+	assert.NoError(t, os.Setenv("RCLONE_BINARY", path))
+	return path
+}
+
 func startDaemon(t *testing.T) {
 	//Launch
 	cmd := rclone.NewRootCmd()
@@ -53,6 +62,8 @@ func testCmdDeamon(t *testing.T) {
 		t.Skipf("Skipping daemon tests since you are not root")
 	}
 
+	fakeRclone(t)
+	defer os.Unsetenv("RCLONE_BINARY")
 	startDaemon(t)
 
 	t.Run("Capabilities", testCapabilities)
@@ -81,6 +92,8 @@ func testCapabilities(t *testing.T) {
 
 func testCmdVersion(t *testing.T) {
 	rclone.Version = "TESTING"
+	path := fakeRclone(t)
+	defer os.Unsetenv("RCLONE_BINARY")
 
 	cmd := rclone.NewRootCmd()
 	b := bytes.NewBufferString("")
@@ -89,7 +102,7 @@ func testCmdVersion(t *testing.T) {
 	cmd.Execute()
 	out, err := ioutil.ReadAll(b)
 	assert.NoError(t, err)
-	assert.Equal(t, "\nVersion: TESTING - Branch:  - Commit:  - BuildTime: \n\n", string(out), "The version returned by CLI is invalid")
+	assert.Equal(t, "\nVersion: TESTING - Branch:  - Commit:  - BuildTime: \nRclone: v1.53.3 ("+path+")\n\n", string(out), "The version returned by CLI is invalid")
 }
 
 func pluginRequest(client *http.Client, method string, req interface{}) (io.Reader, error) {
@@ -2,9 +2,14 @@ package rclone
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
 
+	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -18,7 +23,37 @@ const (
 	VerboseFlag = "verbose"
 	//BasedirFlag flag to set the basedir of mounted volumes
 	BasedirFlag = "basedir"
-	longHelp    = `
+	//RcloneConfigFlag flag to set the rclone config shared by volumes created without config
+	RcloneConfigFlag = "rclone-config"
+	//RemountFlag flag to remount at startup volumes still attached to containers
+	RemountFlag = "remount"
+	//ScopeFlag flag to set the scope of volumes (local or global)
+	ScopeFlag = "scope"
+	//StorePathFlag flag to set the shared folder of volume definitions in global scope
+	StorePathFlag = "store-path"
+	//MountBackendFlag flag to set how volumes are mounted (process or rc)
+	MountBackendFlag = "mount-backend"
+	//RcSocketFlag flag to set the unix socket of the rclone rc daemon
+	RcSocketFlag = "rc-socket"
+	//RcloneBinaryFlag flag to set the rclone binary to use
+	RcloneBinaryFlag = "rclone-binary"
+	//LogMaxSizeFlag flag to set the max size of log files before rotation
+	LogMaxSizeFlag = "log-max-size"
+	//LogMaxFilesFlag flag to set the number of rotated log files kept
+	LogMaxFilesFlag = "log-max-files"
+	//LogMaxAgeFlag flag to set the retention of rotated log files
+	LogMaxAgeFlag = "log-max-age"
+	//MetricsAddrFlag flag to set the listen address of the prometheus metrics endpoint
+	MetricsAddrFlag = "metrics-addr"
+	//AdminSocketFlag flag to set the unix socket of the daemon admin API
+	AdminSocketFlag = "admin-socket"
+	//CommandTimeoutsFlag flag to set the timeouts of external operations by type
+	CommandTimeoutsFlag = "command-timeouts"
+	//LogFile driver log file in verbose mode
+	LogFile = "/var/log/docker-volume-rclone.log"
+	//VolumeLogFolder folder of rclone log files of volumes in verbose mode
+	VolumeLogFolder = "/var/log/rclone"
+	longHelp        = `
 docker-volume-rclone (Rclone Volume Driver Plugin)
 Provides docker volume support for Rclone.
 == Version: %s - Branch: %s - Commit: %s - BuildTime: %s ==
@@ -37,6 +72,16 @@ var (
 	//PluginAlias plugin alias name in docker
 	PluginAlias = "rclone"
 	baseDir     = ""
+	rcloneConf  = ""
+	remount     = false
+	scope       = "local"
+	storePath   = ""
+	backend     = "process"
+	rcSocket    = ""
+	rcloneBin   = ""
+	metricsAddr = ""
+	adminSocket = ""
+	timeouts    = ""
 	daemonCmd   = &cobra.Command{
 		Use:   "daemon",
 		Short: "Run listening volume drive deamon to listen for mount request",
@@ -46,7 +91,14 @@ var (
 		Use:   "version",
 		Short: "Display current version and build date",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			_, err := fmt.Fprintf(cmd.OutOrStdout(), "\nVersion: %s - Branch: %s - Commit: %s - BuildTime: %s\n\n", Version, Branch, Commit, BuildTime)
+			driver.RcloneBinary = rcloneBin
+			var rcloneInfo string
+			if path, version, err := driver.CheckRclone(); err != nil {
+				rcloneInfo = err.Error()
+			} else {
+				rcloneInfo = fmt.Sprintf("%s (%s)", version, path)
+			}
+			_, err := fmt.Fprintf(cmd.OutOrStdout(), "\nVersion: %s - Branch: %s - Commit: %s - BuildTime: %s\nRclone: %s\n\n", Version, Branch, Commit, BuildTime, rcloneInfo)
 			return err
 		},
 	}
@@ -62,9 +114,22 @@ func NewRootCmd() *cobra.Command {
 	}
 	rootCmd.PersistentFlags().BoolP(VerboseFlag, "v", os.Getenv("DEBUG") == "1", "Turns on verbose logging")
 	rootCmd.PersistentFlags().StringVarP(&baseDir, BasedirFlag, "b", filepath.Join(volume.DefaultDockerRootDirectory, PluginAlias), "Mounted volume base directory")
+	rootCmd.PersistentFlags().BoolVar(&remount, RemountFlag, os.Getenv("REMOUNT") == "1", "Remount at startup volumes still attached to containers")
+	rootCmd.PersistentFlags().StringVar(&scope, ScopeFlag, envOrDefault("SCOPE", "local"), "Scope of volumes: local or global (definitions shared between nodes through --store-path)")
+	rootCmd.PersistentFlags().StringVar(&storePath, StorePathFlag, os.Getenv("STORE_PATH"), "Shared folder holding volume definitions in global scope")
+	rootCmd.PersistentFlags().StringVar(&backend, MountBackendFlag, envOrDefault("MOUNT_BACKEND", "process"), "Mount backend: process (one rclone mount per volume) or rc (one rclone rcd for all volumes)")
+	rootCmd.PersistentFlags().StringVar(&rcSocket, RcSocketFlag, os.Getenv("RC_SOCKET"), "Unix socket of the rclone rc daemon, started if not answering (default in "+driver.RuntimeFolder+")")
+	rootCmd.PersistentFlags().StringVar(&rcloneBin, RcloneBinaryFlag, envOrDefault("RCLONE_BINARY", "rclone"), "Rclone binary, looked up in PATH if not a path (minimum version "+driver.MinRcloneVersion+")")
+	rootCmd.PersistentFlags().IntVar(&driver.LogMaxSize, LogMaxSizeFlag, envIntOrDefault("LOG_MAX_SIZE", driver.LogMaxSize), "Max size in megabytes of a log file before rotation")
+	rootCmd.PersistentFlags().IntVar(&driver.LogMaxFiles, LogMaxFilesFlag, envIntOrDefault("LOG_MAX_FILES", driver.LogMaxFiles), "Max number of rotated files kept by log file (0 to keep all)")
+	rootCmd.PersistentFlags().IntVar(&driver.LogMaxAge, LogMaxAgeFlag, envIntOrDefault("LOG_MAX_AGE", driver.LogMaxAge), "Max age in days of rotated log files (0 to keep all)")
+	rootCmd.PersistentFlags().StringVar(&metricsAddr, MetricsAddrFlag, os.Getenv("METRICS_ADDR"), "Listen address of the daemon prometheus metrics endpoint /metrics (ex: :9100, disabled if empty)")
+	rootCmd.PersistentFlags().StringVar(&adminSocket, AdminSocketFlag, envOrDefault("ADMIN_SOCKET", filepath.Join(driver.RuntimeFolder, "admin.sock")), "Unix socket of the daemon admin API used by the volumes and admin commands (disabled if empty)")
+	rootCmd.PersistentFlags().StringVar(&timeouts, CommandTimeoutsFlag, os.Getenv("COMMAND_TIMEOUTS"), fmt.Sprintf("Timeouts in seconds of external operations by type (ex: unmount=60,purge=600), %ds if unset", driver.MountTimeout))
+	rootCmd.PersistentFlags().StringVar(&rcloneConf, RcloneConfigFlag, os.Getenv("RCLONE_CONFIG_FILE"), "Rclone config shared by volumes created without config option (default "+driver.CfgFolder+"rclone.conf)")
 
 	rootCmd.Long = fmt.Sprintf(longHelp, Version, Branch, Commit, BuildTime)
-	rootCmd.AddCommand(versionCmd, daemonCmd)
+	rootCmd.AddCommand(versionCmd, daemonCmd, newVolumesCmd(), newAdminCmd())
 
 	return rootCmd
 }
@@ -79,28 +144,129 @@ func Start() {
 
 //DaemonStart Start the deamon
 func DaemonStart(cmd *cobra.Command, args []string) {
-	d := driver.Init(baseDir)
+	driver.RcloneBinary = rcloneBin
+	path, version, err := driver.CheckRclone()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unsupported rclone binary")
+	}
+	log.Info().Msgf("Using rclone %s from %s", version, path)
+	options, err := driverOptions()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid driver configuration")
+	}
+	d, err := driver.Init(baseDir, options...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to init driver")
+	}
 	log.Debug().Msgf("driver: %v", d)
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", d.MetricsHandler())
+		go func() {
+			log.Info().Msgf("Serving metrics on %s/metrics", metricsAddr)
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				log.Error().Err(err).Msg("Metrics endpoint stopped")
+			}
+		}()
+	}
+	if adminSocket != "" {
+		go func() {
+			if err := d.ServeAdmin(adminSocket); err != nil {
+				log.Error().Err(err).Msg("Admin API stopped")
+			}
+		}()
+	}
 	h := volume.NewHandler(d)
 	log.Debug().Msgf("handler: %v", h)
-	err := h.ServeUnix(PluginAlias, 0)
+	socket := pluginSocket()
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		log.Fatal().Err(err).Msg("Unable to create plugin socket folder")
+	}
+	l, err := sockets.NewUnixSocket(socket, 0)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to listen on plugin socket")
+	}
+	defer os.Remove(socket)
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Info().Msgf("Received %v, stopping", sig)
+		close(stopped)
+		d.Close() //Cancel operations in progress before refusing new requests
+		l.Close()
+	}()
+	err = h.Serve(l)
+	select {
+	case <-stopped:
+	default:
+		if err != nil {
+			log.Error().Err(err).Msg("Plugin API stopped")
+		}
+	}
+}
+
+//driverOptions configure the driver package from flags and return the options of the driver
+func driverOptions() ([]driver.Option, error) {
+	driver.RcloneBinary = rcloneBin
+	driver.SharedConfigFile = rcloneConf
+	driver.RemountOnStart = remount
+	commandTimeouts, err := driver.ParseCommandTimeouts(timeouts)
 	if err != nil {
-		log.Debug().Err(err)
+		return nil, fmt.Errorf("invalid --%s: %v", CommandTimeoutsFlag, err)
+	}
+	driver.CommandTimeouts = commandTimeouts
+	var options []driver.Option
+	switch scope {
+	case "local":
+	case "global":
+		if storePath == "" {
+			return nil, fmt.Errorf("--%s is required in global scope", StorePathFlag)
+		}
+		store, err := driver.NewFileStore(storePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open shared store: %v", err)
+		}
+		options = append(options, driver.WithStore(store))
+	default:
+		return nil, fmt.Errorf("invalid scope %s (local or global)", scope)
+	}
+	driver.Scope = scope
+	switch backend {
+	case "process":
+	case "rc":
+		if err := driver.CheckRcBackend(); err != nil {
+			return nil, err
+		}
+		options = append(options, driver.WithMounter(driver.NewRcMounter(rcSocket)))
+	default:
+		return nil, fmt.Errorf("invalid mount backend %s (process or rc)", backend)
 	}
+	return options, nil
+}
+
+func envOrDefault(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
+func envIntOrDefault(key string, value int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return value
 }
 
 func setupLogger(cmd *cobra.Command, args []string) {
 	logger := zerolog.New(cmd.OutOrStdout())
 	if verbose, _ := cmd.Flags().GetBool(VerboseFlag); verbose {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-		//Activate log to file in debug mode
-		f, err := os.OpenFile("/var/log/docker-volume-rclone.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal().Err(err)
-		}
-		//log.SetOutput(f)
-		//logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
-		logger = zerolog.New(f).With().Timestamp().Logger()
+		//Activate log to rotating files in debug mode
+		logger = zerolog.New(driver.OpenLog(LogFile)).With().Timestamp().Logger()
+		driver.VolumeLogFolder = VolumeLogFolder
 	} else {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
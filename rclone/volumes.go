@@ -0,0 +1,251 @@
+package rclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/spf13/cobra"
+
+	"github.com/sapk/docker-volume-rclone/rclone/driver"
+)
+
+const (
+	//OutputFlag flag to set the output format of volumes commands (table or json)
+	OutputFlag = "output"
+	//ForceFlag flag to force the removal of volumes in use
+	ForceFlag = "force"
+	//pluginSocketFolder folder of docker plugin sockets
+	pluginSocketFolder = "/run/docker/plugins"
+)
+
+var output = "table"
+
+//volumesAdmin administration of volumes, done by the running daemon or offline on its state
+type volumesAdmin interface {
+	Volumes() ([]*volume.Volume, error)
+	Inspect(name string) (*volume.Volume, error)
+	RemoveVolume(name string, force bool) error
+	UnmountVolume(name string) error
+	Prune() ([]string, error)
+}
+
+//newVolumesCmd setup the volumes command to inspect and repair the driver state offline
+func newVolumesCmd() *cobra.Command {
+	volumesCmd := &cobra.Command{
+		Use:   "volumes",
+		Short: "Inspect and repair the state of volumes, through the admin socket of the daemon if running",
+	}
+	volumesCmd.PersistentFlags().StringVarP(&output, OutputFlag, "o", "table", "Output format: table or json")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List volumes with their status",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := openAdmin()
+			if err != nil {
+				return err
+			}
+			vols, err := d.Volumes()
+			if err != nil {
+				return err
+			}
+			return printVolumes(cmd.OutOrStdout(), vols)
+		},
+	}
+	inspectCmd := &cobra.Command{
+		Use:   "inspect VOLUME...",
+		Short: "Display the detailed status of volumes",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := openAdmin()
+			if err != nil {
+				return err
+			}
+			vols := make([]*volume.Volume, 0, len(args))
+			for _, name := range args {
+				vol, err := d.Inspect(name)
+				if err != nil {
+					return err
+				}
+				vols = append(vols, vol)
+			}
+			if output == "json" {
+				return printJSON(cmd.OutOrStdout(), vols)
+			}
+			return printStatus(cmd.OutOrStdout(), vols)
+		},
+	}
+	removeCmd := &cobra.Command{
+		Use:   "remove VOLUME...",
+		Short: "Unmount and remove volumes",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := openAdmin()
+			if err != nil {
+				return err
+			}
+			force, _ := cmd.Flags().GetBool(ForceFlag)
+			for _, name := range args {
+				if err := d.RemoveVolume(name, force); err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), name)
+			}
+			return nil
+		},
+	}
+	removeCmd.Flags().BoolP(ForceFlag, "f", false, "Remove volumes even if used by containers")
+	unmountCmd := &cobra.Command{
+		Use:   "unmount VOLUME...",
+		Short: "Unmount volumes and forget the containers using them",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := openAdmin()
+			if err != nil {
+				return err
+			}
+			for _, name := range args {
+				if err := d.UnmountVolume(name); err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), name)
+			}
+			return nil
+		},
+	}
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove orphan mountpoints, forget stale references and unmount unused mountpoints",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := openAdmin()
+			if err != nil {
+				return err
+			}
+			actions, err := d.Prune()
+			if output == "json" {
+				if errOut := printJSON(cmd.OutOrStdout(), actions); errOut != nil {
+					return errOut
+				}
+			} else {
+				for _, action := range actions {
+					fmt.Fprintln(cmd.OutOrStdout(), action)
+				}
+			}
+			return err
+		},
+	}
+	remountCmd := &cobra.Command{
+		Use:   "remount VOLUME...",
+		Short: "Restart the mount of volumes in place (daemon only)",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := openDaemon()
+			if err != nil {
+				return err
+			}
+			for _, name := range args {
+				if err := c.RemountVolume(name); err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), name)
+			}
+			return nil
+		},
+	}
+	volumesCmd.AddCommand(listCmd, inspectCmd, removeCmd, unmountCmd, remountCmd, pruneCmd)
+	return volumesCmd
+}
+
+//openAdmin return the admin API of the daemon if running or load its state,
+//refusing to touch it if the daemon is running without admin socket (even reading may sync the shared store)
+func openAdmin() (volumesAdmin, error) {
+	if output != "table" && output != "json" {
+		return nil, fmt.Errorf("invalid output format %s (table or json)", output)
+	}
+	if listening(adminSocket) {
+		return driver.NewAdminClient(adminSocket), nil
+	}
+	if listening(pluginSocket()) {
+		return nil, fmt.Errorf("daemon is running on %s without admin socket, restart it with --%s or stop it", pluginSocket(), AdminSocketFlag)
+	}
+	options, err := driverOptions()
+	if err != nil {
+		return nil, err
+	}
+	return driver.Open(baseDir, options...)
+}
+
+//pluginSocket return the unix socket of the daemon
+func pluginSocket() string {
+	return filepath.Join(pluginSocketFolder, PluginAlias+".sock")
+}
+
+//openDaemon return the admin API of the running daemon
+func openDaemon() (*driver.AdminClient, error) {
+	if !listening(adminSocket) {
+		return nil, fmt.Errorf("daemon admin socket %s not available", adminSocket)
+	}
+	return driver.NewAdminClient(adminSocket), nil
+}
+
+//listening check if something answer on the unix socket
+func listening(socket string) bool {
+	if socket == "" {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+//printVolumes write volumes in the output format
+func printVolumes(w io.Writer, vols []*volume.Volume) error {
+	if output == "json" {
+		return printJSON(w, vols)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tREMOTE\tMOUNTPOINT\tCONNECTIONS\tHEALTH")
+	for _, v := range vols {
+		fmt.Fprintf(tw, "%s\t%v\t%s\t%v\t%v\n", v.Name, v.Status["remote"], v.Mountpoint, v.Status["connections"], v.Status["health"])
+	}
+	return tw.Flush()
+}
+
+//printStatus write the status of each volume as a table of key and value
+func printStatus(w io.Writer, vols []*volume.Volume) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, v := range vols {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "name\t%s\nmountpoint\t%s\n", v.Name, v.Mountpoint)
+		keys := make([]string, 0, len(v.Status))
+		for key := range v.Status {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(tw, "%s\t%v\n", key, v.Status[key])
+		}
+	}
+	return tw.Flush()
+}
+
+//printJSON write v as indented json
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}